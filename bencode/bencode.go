@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"math/big"
+	"sort"
 	"strconv"
-	"strings"
 )
 
 // BType 表示Bencode的四种数据类型
@@ -18,6 +19,7 @@ var (
 	ErrEpE = errors.New("expect char e")
 	ErrTyp = errors.New("wrong type")
 	ErrIvd = errors.New("invalid bencode")
+	ErrNil = errors.New("nil object")
 )
 
 const (
@@ -27,13 +29,33 @@ const (
 	BDICT BType = 0x04
 )
 
+func (t BType) String() string {
+	switch t {
+	case BSTR:
+		return "string"
+	case BINT:
+		return "integer"
+	case BLIST:
+		return "list"
+	case BDICT:
+		return "dictionary"
+	}
+	return "unknown"
+}
+
 type BValue interface{}
 
 type BObject struct {
 	type_ BType
-	val_  BValue // 可能是字符串，int, slice指针，k为string, v是bvalue的map
+	val_  BValue // 可能是字符串，int64(超出范围时为*big.Int), slice指针，k为string, v是bvalue的map
+	// 解析时该值在当前顶层值中的起止位置，只在Decode过程中用来截取RawMessage
+	begin, end int64
 }
 
+// RawMessage 一个值原始的bencode编码
+// 反序列化时原样拷贝输入中的字节(比如用来计算info的哈希)，序列化时原样写出
+type RawMessage []byte
+
 func (o *BObject) Str() (string, error) {
 	if o.type_ != BSTR {
 		return "", ErrTyp
@@ -41,11 +63,39 @@ func (o *BObject) Str() (string, error) {
 	return o.val_.(string), nil
 }
 
+// Int 整数超出int的范围时返回ErrOverflow
 func (o *BObject) Int() (int, error) {
+	val, err := o.Int64()
+	if err != nil {
+		return 0, err
+	}
+	if int64(int(val)) != val {
+		return 0, ErrOverflow
+	}
+	return int(val), nil
+}
+
+// Int64 整数超出int64的范围(只有开启UseBigInt时才会出现)时返回ErrOverflow
+func (o *BObject) Int64() (int64, error) {
 	if o.type_ != BINT {
 		return 0, ErrTyp
 	}
-	return o.val_.(int), nil
+	val, ok := o.val_.(int64)
+	if !ok {
+		return 0, ErrOverflow
+	}
+	return val, nil
+}
+
+// BigInt 任意范围的整数都可以取出，返回的是副本
+func (o *BObject) BigInt() (*big.Int, error) {
+	if o.type_ != BINT {
+		return nil, ErrTyp
+	}
+	if val, ok := o.val_.(*big.Int); ok {
+		return new(big.Int).Set(val), nil
+	}
+	return big.NewInt(o.val_.(int64)), nil
 }
 
 func (o *BObject) List() ([]*BObject, error) {
@@ -62,172 +112,180 @@ func (o *BObject) Dict() (map[string]*BObject, error) {
 	return o.val_.(map[string]*BObject), nil
 }
 
+// Bencode 将BObject编码后写入w，返回写入的字节数，出错时返回0
 func (o *BObject) Bencode(w io.Writer) int {
+	n, err := o.WriteTo(w)
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// WriteTo 将BObject编码后写入w，实现io.WriterTo
+func (o *BObject) WriteTo(w io.Writer) (int64, error) {
 	bw := bufio.NewWriter(w)
-	wLen := 0
+	n, err := o.writeTo(bw)
+	if err != nil {
+		return int64(n), err
+	}
+	return int64(n), bw.Flush()
+}
+
+func (o *BObject) writeTo(w *bufio.Writer) (int, error) {
+	// 列表里手动放进去的nil
+	if o == nil {
+		return 0, ErrNil
+	}
 	switch o.type_ {
 	case BSTR:
 		// 先把内内容转字符串
 		str, _ := o.Str()
 		// 再把字符串转bencode
-		wLen += EncodeString(bw, str)
+		return writeString(w, str)
 	case BINT:
-		val, _ := o.Int()
-		wLen += EncodeInt(bw, val)
+		if val, ok := o.val_.(*big.Int); ok {
+			return writeBigInt(w, val)
+		}
+		return writeInt64(w, o.val_.(int64))
 	case BLIST:
-		_ = bw.WriteByte('l')
-		// TODO 忽略错误？
 		list, _ := o.List()
+		if err := w.WriteByte('l'); err != nil {
+			return 0, err
+		}
+		wLen := 1
 		// 递归下降
 		for _, elem := range list {
-			wLen += elem.Bencode(bw)
+			n, err := elem.writeTo(w)
+			wLen += n
+			if err != nil {
+				return wLen, err
+			}
 		}
-		_ = bw.WriteByte('e')
-		wLen += 2
+		if err := w.WriteByte('e'); err != nil {
+			return wLen, err
+		}
+		return wLen + 1, nil
 	case BDICT:
-		_ = bw.WriteByte('d')
 		dict, _ := o.Dict()
-		for k, v := range dict {
-			wLen += EncodeString(bw, k)
-			wLen += v.Bencode(bw)
+		if err := w.WriteByte('d'); err != nil {
+			return 0, err
 		}
-		if err := bw.WriteByte('e'); err != nil {
-			return 0
+		wLen := 1
+		// bencode要求字典的key按字节序排列
+		keys := make([]string, 0, len(dict))
+		for k := range dict {
+			keys = append(keys, k)
 		}
-		wLen += 2
-	}
-	if err := bw.Flush(); err != nil {
-		return 0
+		sort.Strings(keys)
+		for _, k := range keys {
+			n, err := writeString(w, k)
+			wLen += n
+			if err != nil {
+				return wLen, err
+			}
+			n, err = dict[k].writeTo(w)
+			wLen += n
+			if err != nil {
+				return wLen, err
+			}
+		}
+		if err := w.WriteByte('e'); err != nil {
+			return wLen, err
+		}
+		return wLen + 1, nil
 	}
-	return wLen
+	return 0, ErrTyp
 }
 
-func writeDecimal(w *bufio.Writer, val int) (len int) {
-	// TODO 为什么不用itoa
-	s := strconv.Itoa(val)
-	valLen, err := w.WriteString(s)
-	if err != nil {
-		return 0
-	}
-	return valLen
+func writeDecimal(w *bufio.Writer, val int) (int, error) {
+	return w.WriteString(strconv.Itoa(val))
 }
 
-func readDecimal(r *bufio.Reader) (val int, len int) {
-	// 正负数标志
-	sb := strings.Builder{}
-	b, err := r.ReadByte()
-	if err != nil {
-		return 0, 0
-	}
-	if b == '-' {
-		sb.WriteByte(b)
-		b, _ = r.ReadByte()
-		if err != nil {
-			return 0, 0
-		}
-	}
-	for checkNum(b) {
-		sb.WriteByte(b)
-		if b, err = r.ReadByte(); err != nil {
-			return 0, 0
-		}
+func writeInt64(w *bufio.Writer, val int64) (int, error) {
+	return writeRawInt(w, strconv.FormatInt(val, 10))
+}
+
+func writeBigInt(w *bufio.Writer, val *big.Int) (int, error) {
+	return writeRawInt(w, val.String())
+}
+
+// writeRawInt digits是已经转好的十进制数字
+func writeRawInt(w *bufio.Writer, digits string) (int, error) {
+	if err := w.WriteByte('i'); err != nil {
+		return 0, err
 	}
-	if err = r.UnreadByte(); err != nil {
-		return 0, 0
+	wLen := 1
+	n, err := w.WriteString(digits)
+	wLen += n
+	if err != nil {
+		return wLen, err
 	}
-	if val, err = strconv.Atoi(sb.String()); err != nil {
-		return 0, 0
+	if err = w.WriteByte('e'); err != nil {
+		return wLen, err
 	}
-	return val, sb.Len()
+	return wLen + 1, nil
 }
 
 func checkNum(data byte) bool {
 	return data >= '0' && data <= '9'
 }
 
+func writeString(w *bufio.Writer, val string) (int, error) {
+	// wLen是整个的长度，即3:abc的长度
+	wLen, err := writeDecimal(w, len(val))
+	if err != nil {
+		return wLen, err
+	}
+	if err = w.WriteByte(':'); err != nil {
+		return wLen, err
+	}
+	wLen++
+	n, err := w.WriteString(val)
+	return wLen + n, err
+}
+
+func writeInt(w *bufio.Writer, val int) (int, error) {
+	return writeInt64(w, int64(val))
+}
+
+// EncodeString 将字符串编码后写入w，返回写入的字节数，出错时返回0
 func EncodeString(w io.Writer, val string) int {
-	// 求出string的长度
-	strLen := len(val)
 	bw := bufio.NewWriter(w)
-	defer func(bw *bufio.Writer) {
-		_ = bw.Flush()
-	}(bw)
-	// 把长度转string后写入
-	// TODO 返回了啥？
-	// wlen是整个的长度，即3:abc的长度
-	wLen := writeDecimal(bw, strLen)
-	if err := bw.WriteByte(':'); err != nil {
+	wLen, err := writeString(bw, val)
+	if err != nil {
 		return 0
 	}
-	wLen++
-	if _, err := bw.WriteString(val); err != nil {
+	if err = bw.Flush(); err != nil {
 		return 0
 	}
-	wLen += strLen
 	return wLen
 }
 
+// DecodeString 从r中读出一个字符串，r如果是*bufio.Reader则直接复用，不会多读
 func DecodeString(r io.Reader) (val string, err error) {
-	br := bufio.NewReader(r)
-	// 将冒号之前的表示的数字读出来
-	num, intLen := readDecimal(br)
-	if intLen == 0 {
-		return val, ErrNum
-	}
-	// 读冒号
-	b, err := br.ReadByte()
-	if err != nil {
-		return "", err
-	}
-	if b != ':' {
-		return val, ErrCol
-	}
-	// 读取接下来的字符串
-	buf := make([]byte, num)
-	if _, err = io.ReadAtLeast(br, buf, num); err != nil {
-		return "", err
-	}
-	val = string(buf)
-	return
+	return NewDecoder(r).readString()
 }
 
+// EncodeInt 将整数编码后写入w，返回写入的字节数，出错时返回0
 func EncodeInt(w io.Writer, val int) int {
 	bw := bufio.NewWriter(w)
-	defer func(bw *bufio.Writer) {
-		_ = bw.Flush()
-	}(bw)
-	wLen := 0
-	if err := bw.WriteByte('i'); err != nil {
+	wLen, err := writeInt(bw, val)
+	if err != nil {
 		return 0
 	}
-	wLen++
-	nLen := writeDecimal(bw, val)
-	wLen += nLen
-	if err := bw.WriteByte('e'); err != nil {
+	if err = bw.Flush(); err != nil {
 		return 0
 	}
-	wLen++
 	return wLen
 }
 
+// DecodeInt 从r中读出一个整数，r如果是*bufio.Reader则直接复用，不会多读
 func DecodeInt(r io.Reader) (val int, err error) {
-	br, ok := r.(*bufio.Reader)
-	if !ok {
-		br = bufio.NewReader(r)
-	}
-	b, err := br.ReadByte()
+	d := NewDecoder(r)
+	v, err := d.readInt()
 	if err != nil {
-		return 0,err
-	}
-	if b != 'i' {
-		return val, ErrEpI
-	}
-	val, _ = readDecimal(br)
-	if b, err = br.ReadByte(); err != nil {
 		return 0, err
 	}
-	if b != 'e' {
-		return val, ErrEpE
-	}
-	return
+	o := BObject{type_: BINT, val_: v}
+	return o.Int()
 }
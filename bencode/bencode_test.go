@@ -2,7 +2,10 @@ package bencode
 
 import (
 	"bytes"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"math/big"
 	"testing"
 )
 
@@ -46,3 +49,68 @@ func TestInt(t *testing.T) {
 	iv, _ = DecodeInt(buf)
 	assert.Equal(t, val, iv)
 }
+
+func TestIntMalformed(t *testing.T) {
+	for _, in := range []string{"ie", "i-e", "i-0e", "i03e", "i-03e", "i00e", "i1-2e"} {
+		_, err := Parse(bytes.NewBufferString(in))
+		assert.True(t, errors.Is(err, ErrNum) || errors.Is(err, ErrEpE), in)
+	}
+}
+
+func TestInt64(t *testing.T) {
+	in := "i9223372036854775807e"
+	o, err := Parse(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	val, err := o.Int64()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(math.MaxInt64), val)
+	out := new(bytes.Buffer)
+	assert.Equal(t, len(in), o.Bencode(out))
+	assert.Equal(t, in, out.String())
+
+	_, err = Parse(bytes.NewBufferString("i9223372036854775808e"))
+	assert.True(t, errors.Is(err, ErrOverflow))
+}
+
+func TestBigInt(t *testing.T) {
+	in := "i-123456789012345678901234567890e"
+	dec := NewDecoder(bytes.NewBufferString(in))
+	dec.UseBigInt()
+	o, err := dec.Parse()
+	assert.Equal(t, nil, err)
+	_, err = o.Int64()
+	assert.Equal(t, ErrOverflow, err)
+	val, err := o.BigInt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "-123456789012345678901234567890", val.String())
+	out := new(bytes.Buffer)
+	assert.Equal(t, len(in), o.Bencode(out))
+	assert.Equal(t, in, out.String())
+}
+
+type sizes struct {
+	Small int8     `bencode:"small"`
+	Count uint32   `bencode:"count"`
+	Huge  *big.Int `bencode:"huge"`
+}
+
+func TestUnmarshalIntKinds(t *testing.T) {
+	in := "d5:smalli-8e5:counti4000000000e4:hugei99999999999999999999ee"
+	dec := NewDecoder(bytes.NewBufferString(in))
+	dec.UseBigInt()
+	s := &sizes{}
+	assert.Equal(t, nil, dec.Decode(s))
+	assert.Equal(t, int8(-8), s.Small)
+	assert.Equal(t, uint32(4000000000), s.Count)
+	assert.Equal(t, "99999999999999999999", s.Huge.String())
+
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(s))
+	// key按字节序排列
+	assert.Equal(t, "d5:counti4000000000e4:hugei99999999999999999999e5:smalli-8ee", buf.String())
+
+	err := Unmarshal(bytes.NewBufferString("d5:smalli300ee"), &sizes{})
+	assert.True(t, errors.Is(err, ErrOverflow))
+	err = Unmarshal(bytes.NewBufferString("d5:counti-1ee"), &sizes{})
+	assert.True(t, errors.Is(err, ErrOverflow))
+}
@@ -0,0 +1,77 @@
+package bencode
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 二进制字符串在Dump中最多展示的字节数
+const dumpBinaryLen = 32
+
+// Dump 以缩进的树状结构打印BObject，每行标出类型和长度，方便排查种子文件和tracker的回复
+func Dump(w io.Writer, o *BObject, opt JSONOptions) error {
+	bw := bufio.NewWriter(w)
+	dumpObject(bw, o, opt, 0)
+	return bw.Flush()
+}
+
+func dumpObject(w *bufio.Writer, o *BObject, opt JSONOptions, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch o.type_ {
+	case BSTR:
+		_, _ = w.WriteString(dumpString(o.val_.(string), opt))
+	case BINT:
+		val, _ := o.BigInt()
+		_, _ = fmt.Fprintf(w, "int %s", val)
+	case BLIST:
+		_, _ = fmt.Fprintf(w, "list (%d items)", o.Len())
+		o.Each(func(i int, elem *BObject) bool {
+			_, _ = fmt.Fprintf(w, "\n%s  [%d]: ", indent, i)
+			dumpObject(w, elem, opt, depth+1)
+			return true
+		})
+	case BDICT:
+		_, _ = fmt.Fprintf(w, "dict (%d keys)", o.Len())
+		o.Range(func(key string, val *BObject) bool {
+			_, _ = fmt.Fprintf(w, "\n%s  %s: ", indent, dumpKey(key))
+			if opt.Elide && elidedKeys[key] {
+				_, _ = w.WriteString(elide(val))
+			} else {
+				dumpObject(w, val, opt, depth+1)
+			}
+			return true
+		})
+	}
+	if depth == 0 {
+		_ = w.WriteByte('\n')
+	}
+}
+
+func dumpKey(key string) string {
+	if utf8.ValidString(key) {
+		return key
+	}
+	return "0x" + hex.EncodeToString([]byte(key))
+}
+
+// dumpString 文本直接加引号展示，二进制展示成hex或base64，Elide时过长的部分截掉
+func dumpString(str string, opt JSONOptions) string {
+	if utf8.ValidString(str) {
+		return fmt.Sprintf("str(%d) %s", len(str), strconv.Quote(str))
+	}
+	raw := []byte(str)
+	suffix := ""
+	if opt.Elide && len(raw) > dumpBinaryLen {
+		raw, suffix = raw[:dumpBinaryLen], "..."
+	}
+	if opt.Base64 {
+		return fmt.Sprintf("bin(%d) base64:%s%s", len(str), base64.StdEncoding.EncodeToString(raw), suffix)
+	}
+	return fmt.Sprintf("bin(%d) hex:%s%s", len(str), hex.EncodeToString(raw), suffix)
+}
@@ -0,0 +1,54 @@
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrUnknownField 严格模式下字典中出现了结构体里没有的key
+var ErrUnknownField = errors.New("unknown field")
+
+// ErrOverflow 整数超出了目标类型的范围
+var ErrOverflow = errors.New("integer overflow")
+
+// 超出Limits时返回的错误
+var (
+	ErrStringTooLong   = errors.New("string too long")
+	ErrInputTooLarge   = errors.New("input too large")
+	ErrTooDeep         = errors.New("nesting too deep")
+	ErrTooManyElements = errors.New("too many elements")
+)
+
+// SyntaxError 输入不是合法的bencode，Err是具体原因，如ErrNum, ErrCol或io.ErrUnexpectedEOF
+type SyntaxError struct {
+	Offset int64 // 出错字节在输入流中的偏移
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: syntax error at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// UnmarshalTypeError bencode中的值类型和目标Go类型对不上
+type UnmarshalTypeError struct {
+	Path   string       // 出错的位置，如info.files[3].length
+	Type   reflect.Type // 期望的Go类型
+	Actual BType        // bencode中实际的类型
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("bencode: cannot unmarshal %s into value of type %s", e.Actual, e.Type)
+	}
+	return fmt.Sprintf("bencode: cannot unmarshal %s into %s of type %s", e.Actual, e.Path, e.Type)
+}
+
+// Unwrap 兼容之前直接比较ErrTyp的用法
+func (e *UnmarshalTypeError) Unwrap() error {
+	return ErrTyp
+}
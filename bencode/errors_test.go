@@ -0,0 +1,67 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+)
+
+func TestSyntaxErrorOffset(t *testing.T) {
+	cases := []struct {
+		in     string
+		offset int64
+		err    error
+	}{
+		{"d4:name6:archer3:agei29xe", 23, ErrEpE},
+		{"l3:abcx1:ae", 6, ErrIvd},
+		{"d3:key4-abcde", 7, ErrCol},
+		{"li-e", 2, ErrNum},
+	}
+	for _, c := range cases {
+		_, err := Parse(bytes.NewBufferString(c.in))
+		var se *SyntaxError
+		assert.True(t, errors.As(err, &se), c.in)
+		assert.Equal(t, c.offset, se.Offset, c.in)
+		assert.True(t, errors.Is(err, c.err), c.in)
+	}
+}
+
+type tfFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type tfInfo struct {
+	Name  string   `bencode:"name"`
+	Files []tfFile `bencode:"files"`
+}
+
+type tfTorrent struct {
+	Info tfInfo `bencode:"info"`
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	in := "d4:infod5:filesld6:lengthi1e4:pathl1:aeed6:length2:xx4:pathl1:beee4:name1:nee"
+	err := Unmarshal(bytes.NewBufferString(in), &tfTorrent{})
+	var te *UnmarshalTypeError
+	assert.True(t, errors.As(err, &te))
+	assert.Equal(t, "info.files[1].length", te.Path)
+	assert.Equal(t, reflect.TypeOf(0), te.Type)
+	assert.Equal(t, BSTR, te.Actual)
+	assert.True(t, errors.Is(err, ErrTyp))
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	in := "d4:infod4:name1:n7:privatei1eee"
+	tf := &tfTorrent{}
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString(in), tf))
+	assert.Equal(t, "n", tf.Info.Name)
+
+	dec := NewDecoder(bytes.NewBufferString(in))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&tfTorrent{})
+	assert.True(t, errors.Is(err, ErrUnknownField))
+	assert.Contains(t, err.Error(), "info.private")
+}
@@ -0,0 +1,241 @@
+package bencode
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// BObject和JSON之间的对应关系:
+// 字符串是合法UTF-8时对应JSON字符串，否则对应{"$hex": "..."}或{"$base64": "..."}
+// 整数对应JSON数字，不会损失精度，列表对应数组，字典对应对象
+// 字典的key不是合法UTF-8或者本身以"$hex:"开头时，写成"$hex:"加上十六进制
+// 只有一个key且恰好是上面几个标记的字典，会再包一层{"$dict": {...}}，保证可以原样还原
+const (
+	hexMark    = "$hex"
+	base64Mark = "$base64"
+	dictMark   = "$dict"
+	hexKeyPre  = "$hex:"
+)
+
+// JSONOptions 控制BObject转成JSON/YAML时的表现
+type JSONOptions struct {
+	Base64 bool // 二进制字符串用base64而不是十六进制表示
+	Elide  bool // 省略pieces, piece layers这类大块的哈希数据，只保留长度，结果无法再还原成bencode
+}
+
+// 这些key下面是大块的哈希数据，Elide时省略
+var elidedKeys = map[string]bool{
+	"pieces":       true,
+	"piece layers": true,
+}
+
+// ToValue 把BObject转换成encoding/json可以直接处理的值
+func ToValue(o *BObject, opt JSONOptions) interface{} {
+	switch o.type_ {
+	case BSTR:
+		str := o.val_.(string)
+		if utf8.ValidString(str) {
+			return str
+		}
+		return opt.binary(str)
+	case BINT:
+		val, _ := o.BigInt()
+		return json.Number(val.String())
+	case BLIST:
+		list := o.val_.([]*BObject)
+		ret := make([]interface{}, len(list))
+		for i, elem := range list {
+			ret[i] = ToValue(elem, opt)
+		}
+		return ret
+	case BDICT:
+		dict := o.val_.(map[string]*BObject)
+		ret := make(map[string]interface{}, len(dict))
+		for k, v := range dict {
+			if opt.Elide && elidedKeys[k] {
+				ret[jsonKey(k)] = elide(v)
+				continue
+			}
+			ret[jsonKey(k)] = ToValue(v, opt)
+		}
+		if len(ret) == 1 {
+			for k := range ret {
+				if k == hexMark || k == base64Mark || k == dictMark {
+					return map[string]interface{}{dictMark: ret}
+				}
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+func (opt JSONOptions) binary(str string) map[string]interface{} {
+	if opt.Base64 {
+		return map[string]interface{}{base64Mark: base64.StdEncoding.EncodeToString([]byte(str))}
+	}
+	return map[string]interface{}{hexMark: hex.EncodeToString([]byte(str))}
+}
+
+func jsonKey(k string) string {
+	if !utf8.ValidString(k) || strings.HasPrefix(k, hexKeyPre) {
+		return hexKeyPre + hex.EncodeToString([]byte(k))
+	}
+	return k
+}
+
+// elide 用一段描述代替大块数据
+func elide(o *BObject) string {
+	switch o.type_ {
+	case BSTR:
+		n := o.Len()
+		return fmt.Sprintf("<%d bytes, %d hashes elided>", n, n/20)
+	case BDICT:
+		return fmt.Sprintf("<%d layers elided>", o.Len())
+	}
+	return fmt.Sprintf("<%s elided>", o.type_)
+}
+
+// ToJSON 把BObject写成JSON，indent为true时输出带缩进的格式
+func ToJSON(w io.Writer, o *BObject, opt JSONOptions, indent bool) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(ToValue(o, opt))
+}
+
+// ToYAML 把BObject写成YAML，整数同样不会损失精度
+func ToYAML(w io.Writer, o *BObject, opt JSONOptions) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(toYAMLNode(ToValue(o, opt))); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func toYAMLNode(v interface{}) *yaml.Node {
+	switch val := v.(type) {
+	case json.Number:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: string(val)}
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: val}
+	case []interface{}:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, elem := range val {
+			n.Content = append(n.Content, toYAMLNode(elem))
+		}
+		return n
+	case map[string]interface{}:
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		// 和bencode一样按照key排序输出
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			n.Content = append(n.Content, toYAMLNode(k), toYAMLNode(val[k]))
+		}
+		return n
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+}
+
+// FromJSON 读取ToJSON产生的JSON，还原成BObject
+func FromJSON(r io.Reader) (*BObject, error) {
+	dec := json.NewDecoder(r)
+	// 保持整数精度
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return FromValue(v)
+}
+
+// FromValue ToValue的逆过程，v一般是encoding/json使用UseNumber解出来的结果
+func FromValue(v interface{}) (*BObject, error) {
+	switch val := v.(type) {
+	case string:
+		return NewString(val), nil
+	case json.Number:
+		i, ok := new(big.Int).SetString(string(val), 10)
+		if !ok {
+			return nil, fmt.Errorf("bencode: %s is not an integer", val)
+		}
+		return NewBigInt(i), nil
+	case []interface{}:
+		list := NewList()
+		for _, elem := range val {
+			o, err := FromValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			_ = list.Append(o)
+		}
+		return list, nil
+	case map[string]interface{}:
+		if len(val) == 1 {
+			for k, inner := range val {
+				switch k {
+				case hexMark:
+					return fromEncoded(inner, hex.DecodeString)
+				case base64Mark:
+					return fromEncoded(inner, base64.StdEncoding.DecodeString)
+				case dictMark:
+					m, ok := inner.(map[string]interface{})
+					if !ok {
+						return nil, errors.New("bencode: $dict must wrap an object")
+					}
+					return fromMap(m)
+				}
+			}
+		}
+		return fromMap(val)
+	}
+	return nil, fmt.Errorf("bencode: cannot convert %T to bencode", v)
+}
+
+func fromEncoded(v interface{}, decode func(string) ([]byte, error)) (*BObject, error) {
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("bencode: binary string must be a JSON string, got %T", v)
+	}
+	raw, err := decode(str)
+	if err != nil {
+		return nil, err
+	}
+	return NewString(string(raw)), nil
+}
+
+func fromMap(m map[string]interface{}) (*BObject, error) {
+	dict := NewDict()
+	for k, v := range m {
+		key := k
+		if strings.HasPrefix(k, hexKeyPre) {
+			raw, err := hex.DecodeString(k[len(hexKeyPre):])
+			if err != nil {
+				return nil, err
+			}
+			key = string(raw)
+		}
+		o, err := FromValue(v)
+		if err != nil {
+			return nil, err
+		}
+		_ = dict.Set(key, o)
+	}
+	return dict, nil
+}
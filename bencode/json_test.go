@@ -0,0 +1,63 @@
+package bencode
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func jsonRoundTrip(t *testing.T, in string, opt JSONOptions) string {
+	dec := NewDecoder(bytes.NewBufferString(in))
+	dec.UseBigInt()
+	o, err := dec.Parse()
+	assert.Equal(t, nil, err)
+	js := new(bytes.Buffer)
+	assert.Equal(t, nil, ToJSON(js, o, opt, false))
+	back, err := FromJSON(bytes.NewReader(js.Bytes()))
+	assert.Equal(t, nil, err)
+	out := new(bytes.Buffer)
+	_, err = back.WriteTo(out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, in, out.String())
+	return strings.TrimSpace(js.String())
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	js := jsonRoundTrip(t, "d4:name6:archer6:pieces4:\xff\x00\x01\x02e", JSONOptions{})
+	assert.Equal(t, `{"name":"archer","pieces":{"$hex":"ff000102"}}`, js)
+	js = jsonRoundTrip(t, "l4:\xff\x00\x01\x02e", JSONOptions{Base64: true})
+	assert.Equal(t, `[{"$base64":"/wABAg=="}]`, js)
+	js = jsonRoundTrip(t, "li123456789012345678901e2:<>e", JSONOptions{})
+	assert.Equal(t, `[123456789012345678901,"<>"]`, js)
+}
+
+func TestJSONAmbiguousDict(t *testing.T) {
+	// 真实的字典恰好只有一个标记key时不能被当成二进制字符串
+	js := jsonRoundTrip(t, "d4:$hex2:ffe", JSONOptions{})
+	assert.Equal(t, `{"$dict":{"$hex":"ff"}}`, js)
+	jsonRoundTrip(t, "d5:$dictd4:$hex2:ffee", JSONOptions{})
+	// 二进制的key和以$hex:开头的key
+	js = jsonRoundTrip(t, "d7:$hex:ab1:x2:\xff\x011:xe", JSONOptions{})
+	assert.Equal(t, `{"$hex:246865783a6162":"x","$hex:ff01":"x"}`, js)
+}
+
+func TestJSONElide(t *testing.T) {
+	o, _ := Parse(bytes.NewBufferString("d4:infod6:pieces40:" + strings.Repeat("\xff", 40) + "ee"))
+	js := new(bytes.Buffer)
+	assert.Equal(t, nil, ToJSON(js, o, JSONOptions{Elide: true}, false))
+	assert.Equal(t, `{"info":{"pieces":"<40 bytes, 2 hashes elided>"}}`, strings.TrimSpace(js.String()))
+
+	dump := new(bytes.Buffer)
+	assert.Equal(t, nil, Dump(dump, o, JSONOptions{Elide: true}))
+	assert.Equal(t, "dict (1 keys)\n  info: dict (1 keys)\n    pieces: <40 bytes, 2 hashes elided>\n", dump.String())
+}
+
+func TestYAML(t *testing.T) {
+	dec := NewDecoder(bytes.NewBufferString("d1:bli1ei99999999999999999999ee1:a2:\xff\x00e"))
+	dec.UseBigInt()
+	o, _ := dec.Parse()
+	out := new(bytes.Buffer)
+	assert.Equal(t, nil, ToYAML(out, o, JSONOptions{}))
+	assert.Equal(t, "a:\n  $hex: ff00\nb:\n  - 1\n  - !!int 99999999999999999999\n", out.String())
+}
@@ -0,0 +1,58 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func decodeWithLimits(in string, l Limits) error {
+	dec := NewDecoder(bytes.NewBufferString(in))
+	dec.SetLimits(l)
+	_, err := dec.Parse()
+	return err
+}
+
+func TestLimitStringLen(t *testing.T) {
+	// 声明了一个超大的长度但是没有数据，不能按照声明去分配内存
+	err := decodeWithLimits("9999999999:abc", DefaultLimits)
+	assert.True(t, errors.Is(err, ErrStringTooLong))
+	err = decodeWithLimits("5:abcde", Limits{MaxStringLen: 4})
+	assert.True(t, errors.Is(err, ErrStringTooLong))
+	assert.Equal(t, nil, decodeWithLimits("4:abcd", Limits{MaxStringLen: 4}))
+}
+
+func TestLimitInputSize(t *testing.T) {
+	in := "l" + strings.Repeat("i1e", 10) + "e"
+	assert.Equal(t, nil, decodeWithLimits(in, Limits{MaxInputSize: int64(len(in))}))
+	err := decodeWithLimits(in, Limits{MaxInputSize: int64(len(in) - 1)})
+	assert.True(t, errors.Is(err, ErrInputTooLarge))
+
+	// 每个值单独计算
+	dec := NewDecoder(bytes.NewBufferString("4:abcd4:abcd"))
+	dec.SetLimits(Limits{MaxInputSize: 6})
+	for i := 0; i < 2; i++ {
+		_, err = dec.Parse()
+		assert.Equal(t, nil, err)
+	}
+}
+
+func TestLimitDepth(t *testing.T) {
+	in := strings.Repeat("l", 10) + strings.Repeat("e", 10)
+	assert.Equal(t, nil, decodeWithLimits(in, Limits{MaxDepth: 10}))
+	err := decodeWithLimits(in, Limits{MaxDepth: 9})
+	assert.True(t, errors.Is(err, ErrTooDeep))
+
+	// 默认限制下深度攻击不会导致栈溢出
+	in = strings.Repeat("l", 100000) + strings.Repeat("e", 100000)
+	err = Unmarshal(bytes.NewBufferString(in), &[]int{})
+	assert.True(t, errors.Is(err, ErrTooDeep))
+}
+
+func TestLimitElements(t *testing.T) {
+	err := decodeWithLimits("d1:ai1e1:bli1ei2eee", Limits{MaxElements: 3})
+	assert.True(t, errors.Is(err, ErrTooManyElements))
+	assert.Equal(t, nil, decodeWithLimits("d1:ai1e1:bli1ei2eee", Limits{MaxElements: 4}))
+}
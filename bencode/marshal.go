@@ -1,230 +1,305 @@
 package bencode
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 func Unmarshal(r io.Reader, s interface{}) error {
-	// 非指针报错
-	p := reflect.ValueOf(s)
-	if p.Kind() != reflect.Ptr {
-		return errors.New("dest must be a pointer")
+	return NewDecoder(r).Decode(s)
+}
+
+// unmarshal 根据v的类型把o的内容写进去，v必须是可以Set的值
+// path记录当前位置，如info.files[3].length，用于报错
+func (d *Decoder) unmarshal(v reflect.Value, o *BObject, path string) error {
+	// 指针先分配空间再往下走，*BObject类型的字段直接保存原始对象
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.unmarshal(v.Elem(), o, path)
 	}
-	// 解析成BObject
-	o, err := Parse(r)
-	if err != nil {
-		return err
+	if v.Type() == bobjectType {
+		v.Set(reflect.ValueOf(*o))
+		return nil
 	}
-	switch o.type_ {
-	case BLIST:
-		list, err := o.List()
+	if v.Type() == rawMessageType {
+		raw, err := d.rawBytes(o)
 		if err != nil {
 			return err
 		}
-		// p实际只提供一个类型的模板，并不需要对p直接操作，而是根据p的类型去构造新的值对象
-		l := reflect.MakeSlice(p.Elem().Type(), len(list), len(list))
-		p.Elem().Set(l)
-		if err = unmarshalList(p, list); err != nil {
-			return err
+		v.SetBytes(raw)
+		return nil
+	}
+	switch o.type_ {
+	case BSTR:
+		val, _ := o.Str()
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(val)
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes([]byte(val))
+		default:
+			return &UnmarshalTypeError{Path: path, Type: v.Type(), Actual: o.type_}
 		}
+	case BINT:
+		return unmarshalInt(v, o, path)
+	case BLIST:
+		list, _ := o.List()
+		if v.Kind() != reflect.Slice {
+			return &UnmarshalTypeError{Path: path, Type: v.Type(), Actual: o.type_}
+		}
+		return d.unmarshalList(v, list, path)
 	case BDICT:
-		// 传进来一般都是struct,不需要去构建slice
 		dict, _ := o.Dict()
-		err = unmarshalDict(p, dict)
-		if err != nil {
-			return err
+		switch v.Kind() {
+		case reflect.Struct:
+			return d.unmarshalDict(v, dict, path)
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return &UnmarshalTypeError{Path: path, Type: v.Type(), Actual: o.type_}
+			}
+			return d.unmarshalMap(v, dict, path)
+		default:
+			return &UnmarshalTypeError{Path: path, Type: v.Type(), Actual: o.type_}
 		}
-	default:
-		return errors.New("src code must be struct or slice")
 	}
 	return nil
 }
 
-// unmarshalList
-func unmarshalList(p reflect.Value, list []*BObject) error {
-	// p需要是指针
-	// p指向的值的类型必须是slice
-	if p.Kind() != reflect.Ptr || p.Elem().Type().Kind() != reflect.Slice {
-		return errors.New("dest must be pointer to slice")
+var (
+	bobjectType    = reflect.TypeOf(BObject{})
+	bigIntType     = reflect.TypeOf(big.Int{})
+	rawMessageType = reflect.TypeOf(RawMessage{})
+)
+
+// rawBytes 优先使用输入中的原始字节，没有记录时重新编码
+func (d *Decoder) rawBytes(o *BObject) ([]byte, error) {
+	if d.rec && o.end > o.begin && o.end <= int64(len(d.raw)) {
+		return append([]byte(nil), d.raw[o.begin:o.end]...), nil
 	}
-	v := p.Elem()
-	if len(list) == 0 {
+	buf := new(bytes.Buffer)
+	if _, err := o.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalInt 支持各种宽度的有符号和无符号整数以及big.Int，放不下时返回ErrOverflow
+func unmarshalInt(v reflect.Value, o *BObject, path string) error {
+	if v.Type() == bigIntType {
+		val, _ := o.BigInt()
+		v.Set(reflect.ValueOf(*val))
 		return nil
 	}
-	switch list[0].type_ {
-	case BSTR:
-		for i, o := range list {
-			val, err := o.Str()
-			if err != nil {
-				return err
-			}
-			v.Index(i).SetString(val)
+	overflow := func() error {
+		return fmt.Errorf("bencode: %w: cannot unmarshal %s into %s of type %s", ErrOverflow, o.val_, path, v.Type())
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val, err := o.Int64()
+		if err != nil || v.OverflowInt(val) {
+			return overflow()
 		}
-	case BINT:
-		for i, o := range list {
-			val, err := o.Int()
-			if err != nil {
-				return err
-			}
-			v.Index(i).SetInt(int64(val))
-		}
-	case BLIST:
-		for i, o := range list {
-			val, err := o.List()
-			if err != nil {
-				return err
-			}
-			// 保证列表的元素也是列表
-			if v.Type().Elem().Kind() != reflect.Slice {
-				return ErrTyp
-			}
-			// 做一个指针指向数组地址
-			lp := reflect.New(v.Type().Elem())
-			// 开拓带有长度等信息的数组并指向
-			ls := reflect.MakeSlice(v.Type().Elem(), len(val), len(val))
-			lp.Elem().Set(ls)
-			if err = unmarshalList(lp, val); err != nil {
-				return err
-			}
-			v.Index(i).Set(lp.Elem())
-		}
-	case BDICT:
-		for i, o := range list {
-			val, err := o.Dict()
-			if v.Type().Elem().Kind() != reflect.Struct {
-				return ErrTyp
-			}
-			dp := reflect.New(v.Type().Elem())
-			err = unmarshalDict(dp, val)
-			if err != nil {
-				return err
-			}
-			v.Index(i).Set(dp.Elem())
+		v.SetInt(val)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		val, _ := o.BigInt()
+		if val.Sign() < 0 || !val.IsUint64() || v.OverflowUint(val.Uint64()) {
+			return overflow()
 		}
+		v.SetUint(val.Uint64())
+	default:
+		return &UnmarshalTypeError{Path: path, Type: v.Type(), Actual: o.type_}
 	}
 	return nil
 }
 
-func unmarshalDict(p reflect.Value, dict map[string]*BObject) error {
-	if p.Kind() != reflect.Ptr || p.Elem().Type().Kind() != reflect.Struct {
-		return errors.New("dest must be a pointer")
-	}
-	v := p.Elem()
-	for i, n := 0, v.NumField(); i < n; i++ {
-		// 遍历每一个字段，找可以bencode里的值
-		fv := v.Field(i)
-		if !fv.CanSet() {
-			continue
-		}
-		ft := v.Type().Field(i)
-		key := ft.Tag.Get("bencode")
-		// 如果没有tag,使用结构体名字
-		if key == "" {
-			key = strings.ToLower(ft.Name)
+// unmarshalList v的类型已经确定是slice
+func (d *Decoder) unmarshalList(v reflect.Value, list []*BObject, path string) error {
+	// v实际只提供一个类型的模板，根据v的类型去构造新的slice
+	ls := reflect.MakeSlice(v.Type(), len(list), len(list))
+	for i, o := range list {
+		// 递归下降，列表的元素也可以是列表或字典
+		if err := d.unmarshal(ls.Index(i), o, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+			return err
 		}
-		fo := dict[key]
+	}
+	v.Set(ls)
+	return nil
+}
+
+// unmarshalDict 遍历结构体的每一个字段，在字典里找对应的值
+func (d *Decoder) unmarshalDict(v reflect.Value, dict map[string]*BObject, path string) error {
+	fields := structFields(v.Type())
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		known[f.key] = true
+		fo := dict[f.key]
 		if fo == nil {
 			continue
 		}
-		switch fo.type_ {
-		case BSTR:
-			if ft.Type.Kind() != reflect.String {
-				break
-			}
-			val, err := fo.Str()
-			if err != nil {
-				return err
-			}
-			fv.SetString(val)
-		case BINT:
-			if ft.Type.Kind() != reflect.Int {
-				break
-			}
-			val, err := fo.Int()
-			if err != nil {
-				return err
-			}
-			fv.SetInt(int64(val))
-		case BLIST:
-			if ft.Type.Kind() != reflect.Slice {
-				break
-			}
-			list, err := fo.List()
-			if err != nil {
-				return err
-			}
-			lp := reflect.New(ft.Type)
-			ls := reflect.MakeSlice(ft.Type, len(list), len(list))
-			lp.Elem().Set(ls)
-			if err = unmarshalList(lp, list); err != nil {
-				break
-			}
-			fv.Set(lp.Elem())
-		case BDICT:
-			if ft.Type.Kind() != reflect.Struct {
-				break
-			}
-			dp := reflect.New(ft.Type)
-			d, _ := fo.Dict()
-			if err := unmarshalDict(dp, d); err != nil {
-				break
+		if err := d.unmarshal(v.Field(f.index), fo, joinPath(path, f.key)); err != nil {
+			return err
+		}
+	}
+	if d.strict {
+		for key := range dict {
+			if !known[key] {
+				return fmt.Errorf("bencode: %w %s", ErrUnknownField, joinPath(path, key))
 			}
-			fv.Set(dp.Elem())
 		}
 	}
 	return nil
 }
 
+func (d *Decoder) unmarshalMap(v reflect.Value, dict map[string]*BObject, path string) error {
+	m := reflect.MakeMapWithSize(v.Type(), len(dict))
+	for key, o := range dict {
+		ev := reflect.New(v.Type().Elem()).Elem()
+		if err := d.unmarshal(ev, o, joinPath(path, key)); err != nil {
+			return err
+		}
+		m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), ev)
+	}
+	v.Set(m)
+	return nil
+}
+
+// fieldKey 字段在字典中对应的key，如果没有tag,使用小写的字段名
+func fieldKey(ft reflect.StructField) string {
+	key := ft.Tag.Get("bencode")
+	if key == "" {
+		key = strings.ToLower(ft.Name)
+	}
+	return key
+}
+
+type structField struct {
+	index int
+	key   string
+}
+
+// structFields 参与编解码的字段，按key排序，跳过未导出的和tag为"-"的字段
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		ft := t.Field(i)
+		if ft.PkgPath != "" || ft.Tag.Get("bencode") == "-" {
+			continue
+		}
+		fields = append(fields, structField{i, fieldKey(ft)})
+	}
+	// bencode要求字典的key按字节序排列，info hash依赖这一点
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Marshal 将s编码后写入w，返回写入的字节数，出错时返回0，需要具体错误请使用Encoder
 func Marshal(w io.Writer, s interface{}) int {
 	v := reflect.ValueOf(s)
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
-	return marshalValue(w, v)
+	bw := bufio.NewWriter(w)
+	wLen, err := marshalValue(bw, v)
+	if err != nil {
+		return 0
+	}
+	if err = bw.Flush(); err != nil {
+		return 0
+	}
+	return wLen
 }
 
-func marshalValue(w io.Writer, v reflect.Value) int {
-	wLen := 0
+func marshalValue(w *bufio.Writer, v reflect.Value) (int, error) {
 	switch v.Kind() {
 	case reflect.String:
-		wLen += EncodeString(w, v.String())
-	case reflect.Int:
-		wLen += EncodeInt(w, int(v.Int()))
+		return writeString(w, v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return writeInt64(w, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return writeRawInt(w, strconv.FormatUint(v.Uint(), 10))
 	case reflect.Slice:
-		wLen += marshalList(w, v)
+		if v.Type() == rawMessageType {
+			return w.Write(v.Bytes())
+		}
+		// []byte按照字符串处理
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return writeString(w, string(v.Bytes()))
+		}
+		return marshalList(w, v)
 	case reflect.Struct:
-		wLen += marshalDict(w, v)
+		if v.Type() == bigIntType {
+			val := v.Interface().(big.Int)
+			return writeBigInt(w, &val)
+		}
+		return marshalDict(w, v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0, fmt.Errorf("bencode: cannot marshal nil %s", v.Type())
+		}
+		return marshalValue(w, v.Elem())
 	}
-	return wLen
+	if !v.IsValid() {
+		return 0, errors.New("bencode: cannot marshal nil value")
+	}
+	return 0, fmt.Errorf("bencode: unsupported type %s", v.Type())
 }
 
-func marshalList(w io.Writer, v reflect.Value) int {
-	wLen := 2
-	_, _ = w.Write([]byte{'l'})
+func marshalList(w *bufio.Writer, v reflect.Value) (int, error) {
+	if err := w.WriteByte('l'); err != nil {
+		return 0, err
+	}
+	wLen := 1
 	for i := 0; i < v.Len(); i++ {
-		e := v.Index(i)
-		wLen += marshalValue(w, e)
+		n, err := marshalValue(w, v.Index(i))
+		wLen += n
+		if err != nil {
+			return wLen, err
+		}
 	}
-	_, _ = w.Write([]byte{'e'})
-	return wLen
+	if err := w.WriteByte('e'); err != nil {
+		return wLen, err
+	}
+	return wLen + 1, nil
 }
 
-func marshalDict(w io.Writer, v reflect.Value) int {
-	wLen := 2
-	_, _ = w.Write([]byte{'d'})
-	for i := 0; i < v.NumField(); i++ {
-		fv := v.Field(i)
-		ft := v.Type().Field(i)
-		key := ft.Tag.Get("bencode")
-		if key == "" {
-			key = strings.ToLower(ft.Name)
+func marshalDict(w *bufio.Writer, v reflect.Value) (int, error) {
+	if err := w.WriteByte('d'); err != nil {
+		return 0, err
+	}
+	wLen := 1
+	for _, f := range structFields(v.Type()) {
+		n, err := writeString(w, f.key)
+		wLen += n
+		if err != nil {
+			return wLen, err
+		}
+		n, err = marshalValue(w, v.Field(f.index))
+		wLen += n
+		if err != nil {
+			return wLen, err
 		}
-		wLen += EncodeString(w, key)
-		wLen += marshalValue(w, fv)
 	}
-	_, _ = w.Write([]byte{'e'})
-	return wLen
+	if err := w.WriteByte('e'); err != nil {
+		return wLen, err
+	}
+	return wLen + 1, nil
 }
@@ -53,7 +53,7 @@ func TestUnmarshalList(t *testing.T) {
 }
 
 func TestUnmarshalUser(t *testing.T) {
-	str := "d4:name6:archer3:agei29ee"
+	str := "d3:agei29e4:name6:archere"
 	u := &User{}
 	_ = Unmarshal(bytes.NewBufferString(str), u)
 	assert.Equal(t, "archer", u.Name)
@@ -66,7 +66,7 @@ func TestUnmarshalUser(t *testing.T) {
 }
 
 func TestUnmarshalRole(t *testing.T) {
-	str := "d2:idi1e4:userd4:name6:archer3:agei29eee"
+	str := "d2:idi1e4:userd3:agei29e4:name6:archeree"
 	r := &Role{}
 	_ = Unmarshal(bytes.NewBufferString(str), r)
 	assert.Equal(t, 1, r.Id)
@@ -80,7 +80,7 @@ func TestUnmarshalRole(t *testing.T) {
 }
 
 func TestUnmarshalScore(t *testing.T) {
-	str := "d4:userd4:name6:archer3:agei29ee5:valueli80ei85ei90eee"
+	str := "d4:userd3:agei29e4:name6:archere5:valueli80ei85ei90eee"
 	s := &Score{}
 	_ = Unmarshal(bytes.NewBufferString(str), s)
 	assert.Equal(t, "archer", s.Name)
@@ -94,7 +94,7 @@ func TestUnmarshalScore(t *testing.T) {
 }
 
 func TestUnmarshalTeam(t *testing.T) {
-	str := "d4:name3:ace4:sizei2e6:memberld4:name6:archer3:agei29eed4:name5:nancy3:agei31eeee"
+	str := "d6:memberld3:agei29e4:name6:archered3:agei31e4:name5:nancyee4:name3:ace4:sizei2ee"
 	team := &Team{}
 	_ = Unmarshal(bytes.NewBufferString(str), team)
 	assert.Equal(t, "ace", team.Name)
@@ -104,3 +104,16 @@ func TestUnmarshalTeam(t *testing.T) {
 	assert.Equal(t, len(str), length)
 	assert.Equal(t, str, buf.String())
 }
+
+func TestMarshalSortedKeys(t *testing.T) {
+	s := struct {
+		Zed    string
+		Alpha  int
+		hidden int
+		Skip   string `bencode:"-"`
+	}{"x", 1, 2, "skip"}
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(&s))
+	// key排序，未导出和"-"的字段不编码
+	assert.Equal(t, "d5:alphai1e3:zed1:xe", buf.String())
+}
@@ -0,0 +1,261 @@
+package bencode
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NewString 构造一个字符串类型的BObject
+func NewString(val string) *BObject {
+	return &BObject{type_: BSTR, val_: val}
+}
+
+// NewInt 构造一个整数类型的BObject
+func NewInt(val int64) *BObject {
+	return &BObject{type_: BINT, val_: val}
+}
+
+// NewBigInt 构造一个整数类型的BObject，能放进int64时按int64保存，nil按0处理
+func NewBigInt(val *big.Int) *BObject {
+	if val == nil {
+		return NewInt(0)
+	}
+	if val.IsInt64() {
+		return NewInt(val.Int64())
+	}
+	return &BObject{type_: BINT, val_: new(big.Int).Set(val)}
+}
+
+// NewList 构造一个列表类型的BObject，nil元素会被去掉，和Append一样列表中不会出现nil
+func NewList(elems ...*BObject) *BObject {
+	list := make([]*BObject, 0, len(elems))
+	for _, elem := range elems {
+		if elem != nil {
+			list = append(list, elem)
+		}
+	}
+	return &BObject{type_: BLIST, val_: list}
+}
+
+// NewDict 构造一个空的字典类型的BObject
+func NewDict() *BObject {
+	return &BObject{type_: BDICT, val_: make(map[string]*BObject)}
+}
+
+// Type 返回BObject的类型
+func (o *BObject) Type() BType {
+	return o.type_
+}
+
+// SetString 将o替换成字符串
+func (o *BObject) SetString(val string) {
+	o.type_, o.val_ = BSTR, val
+}
+
+// SetInt 将o替换成整数
+func (o *BObject) SetInt(val int64) {
+	o.type_, o.val_ = BINT, val
+}
+
+// Set 设置字典中key对应的值，val为nil时删除key，o不是字典时返回ErrTyp
+func (o *BObject) Set(key string, val *BObject) error {
+	dict, err := o.Dict()
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		delete(dict, key)
+		return nil
+	}
+	dict[key] = val
+	return nil
+}
+
+// Delete 删除字典中的key，o不是字典时返回ErrTyp
+func (o *BObject) Delete(key string) error {
+	dict, err := o.Dict()
+	if err != nil {
+		return err
+	}
+	delete(dict, key)
+	return nil
+}
+
+// Append 在列表末尾追加元素，o不是列表时返回ErrTyp，元素有nil时返回ErrNil
+func (o *BObject) Append(elems ...*BObject) error {
+	list, err := o.List()
+	if err != nil {
+		return err
+	}
+	for _, elem := range elems {
+		if elem == nil {
+			return ErrNil
+		}
+	}
+	o.val_ = append(list, elems...)
+	return nil
+}
+
+// Len 字符串的字节数，列表的元素个数或者字典的key个数，整数返回0
+func (o *BObject) Len() int {
+	switch o.type_ {
+	case BSTR:
+		return len(o.val_.(string))
+	case BLIST:
+		return len(o.val_.([]*BObject))
+	case BDICT:
+		return len(o.val_.(map[string]*BObject))
+	}
+	return 0
+}
+
+// Keys 返回字典中排好序的key，和编码时的顺序一致
+func (o *BObject) Keys() []string {
+	dict, err := o.Dict()
+	if err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Range 按照key的顺序遍历字典，fn返回false时停止
+func (o *BObject) Range(fn func(key string, val *BObject) bool) {
+	dict, err := o.Dict()
+	if err != nil {
+		return
+	}
+	for _, k := range o.Keys() {
+		if !fn(k, dict[k]) {
+			return
+		}
+	}
+}
+
+// Each 按顺序遍历列表，fn返回false时停止
+func (o *BObject) Each(fn func(i int, val *BObject) bool) {
+	list, err := o.List()
+	if err != nil {
+		return
+	}
+	for i, elem := range list {
+		if !fn(i, elem) {
+			return
+		}
+	}
+}
+
+// Get 按照路径查找子对象，路径用/分隔，字典用key，列表用下标，如info/files/0/path
+// 空路径返回o本身
+func (o *BObject) Get(path string) (*BObject, error) {
+	cur := o
+	if path == "" {
+		return cur, nil
+	}
+	for i, seg := range strings.Split(path, "/") {
+		switch cur.type_ {
+		case BDICT:
+			next, ok := cur.val_.(map[string]*BObject)[seg]
+			if !ok {
+				return nil, fmt.Errorf("bencode: key %q not found at %s", seg, joinSegs(path, i))
+			}
+			cur = next
+		case BLIST:
+			list := cur.val_.([]*BObject)
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(list) {
+				return nil, fmt.Errorf("bencode: index %q out of range at %s", seg, joinSegs(path, i))
+			}
+			cur = list[idx]
+		default:
+			return nil, fmt.Errorf("bencode: cannot index %s at %s: %w", cur.type_, joinSegs(path, i), ErrTyp)
+		}
+	}
+	return cur, nil
+}
+
+// joinSegs 报错时展示路径的前n段
+func joinSegs(path string, n int) string {
+	segs := strings.Split(path, "/")
+	if n == 0 {
+		return "/"
+	}
+	return strings.Join(segs[:n], "/")
+}
+
+// Equal 深度比较两个BObject，字典不关心key的插入顺序
+func (o *BObject) Equal(other *BObject) bool {
+	if o == nil || other == nil {
+		return o == other
+	}
+	if o.type_ != other.type_ {
+		return false
+	}
+	switch o.type_ {
+	case BSTR:
+		return o.val_.(string) == other.val_.(string)
+	case BINT:
+		a, _ := o.BigInt()
+		b, _ := other.BigInt()
+		return a.Cmp(b) == 0
+	case BLIST:
+		a, b := o.val_.([]*BObject), other.val_.([]*BObject)
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !a[i].Equal(b[i]) {
+				return false
+			}
+		}
+		return true
+	case BDICT:
+		a, b := o.val_.(map[string]*BObject), other.val_.(map[string]*BObject)
+		if len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if !v.Equal(b[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Clone 深拷贝，修改副本不会影响原对象
+func (o *BObject) Clone() *BObject {
+	if o == nil {
+		return nil
+	}
+	switch o.type_ {
+	case BINT:
+		if val, ok := o.val_.(*big.Int); ok {
+			return &BObject{type_: BINT, val_: new(big.Int).Set(val)}
+		}
+	case BLIST:
+		list := o.val_.([]*BObject)
+		cp := make([]*BObject, len(list))
+		for i, elem := range list {
+			cp[i] = elem.Clone()
+		}
+		return &BObject{type_: BLIST, val_: cp}
+	case BDICT:
+		dict := o.val_.(map[string]*BObject)
+		cp := make(map[string]*BObject, len(dict))
+		for k, v := range dict {
+			cp[k] = v.Clone()
+		}
+		return &BObject{type_: BDICT, val_: cp}
+	}
+	// 字符串和int64本身就是值
+	return &BObject{type_: o.type_, val_: o.val_}
+}
@@ -0,0 +1,125 @@
+package bencode
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+func buildTorrent() *BObject {
+	file := NewDict()
+	_ = file.Set("length", NewInt(1024))
+	_ = file.Set("path", NewList(NewString("dir"), NewString("a.txt")))
+	info := NewDict()
+	_ = info.Set("name", NewString("bundle"))
+	_ = info.Set("files", NewList(file))
+	root := NewDict()
+	_ = root.Set("announce", NewString("http://tracker/announce"))
+	_ = root.Set("info", info)
+	return root
+}
+
+func TestObjectBuild(t *testing.T) {
+	root := buildTorrent()
+	out := new(bytes.Buffer)
+	_, err := root.WriteTo(out)
+	assert.Equal(t, nil, err)
+	in := "d8:announce23:http://tracker/announce4:infod5:filesld6:lengthi1024e4:pathl3:dir5:a.txteee4:name6:bundleee"
+	assert.Equal(t, in, out.String())
+
+	parsed, err := Parse(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	assert.True(t, parsed.Equal(root))
+}
+
+func TestObjectGet(t *testing.T) {
+	root := buildTorrent()
+	o, err := root.Get("info/files/0/path/1")
+	assert.Equal(t, nil, err)
+	objAssertStr(t, "a.txt", o)
+	o, err = root.Get("info/files/0/length")
+	assert.Equal(t, nil, err)
+	objAssertInt(t, 1024, o)
+	o, err = root.Get("")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, root, o)
+
+	_, err = root.Get("info/files/1")
+	assert.NotEqual(t, nil, err)
+	_, err = root.Get("info/missing")
+	assert.NotEqual(t, nil, err)
+	_, err = root.Get("announce/x")
+	assert.ErrorIs(t, err, ErrTyp)
+}
+
+func TestObjectEdit(t *testing.T) {
+	root := buildTorrent()
+	cp := root.Clone()
+	assert.True(t, cp.Equal(root))
+
+	_ = cp.Set("comment", NewString("edited"))
+	files, _ := cp.Get("info/files")
+	_ = files.Append(NewDict())
+	name, _ := cp.Get("info/name")
+	name.SetString("renamed")
+	assert.False(t, cp.Equal(root))
+	assert.Equal(t, []string{"announce", "info"}, root.Keys())
+	assert.Equal(t, []string{"announce", "comment", "info"}, cp.Keys())
+	assert.Equal(t, 2, files.Len())
+	origFiles, _ := root.Get("info/files")
+	assert.Equal(t, 1, origFiles.Len())
+
+	_ = cp.Delete("comment")
+	var keys []string
+	cp.Range(func(key string, _ *BObject) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"announce", "info"}, keys)
+	assert.Equal(t, ErrTyp, name.Set("k", NewInt(1)))
+	assert.Equal(t, ErrTyp, name.Append(NewInt(1)))
+
+	var sum int64
+	NewList(NewInt(1), NewInt(2), NewInt(3)).Each(func(_ int, val *BObject) bool {
+		v, _ := val.Int64()
+		sum += v
+		return true
+	})
+	assert.Equal(t, int64(6), sum)
+}
+
+func TestObjectBigInt(t *testing.T) {
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	o := NewBigInt(huge)
+	assert.True(t, o.Equal(o.Clone()))
+	assert.False(t, o.Equal(NewInt(1)))
+	assert.True(t, NewBigInt(big.NewInt(7)).Equal(NewInt(7)))
+	assert.True(t, NewBigInt(nil).Equal(NewInt(0)))
+}
+
+func TestObjectNil(t *testing.T) {
+	d := NewDict()
+	_ = d.Set("a", NewInt(1))
+	// 设置为nil等于删除
+	assert.Equal(t, nil, d.Set("a", nil))
+	assert.Equal(t, 0, d.Len())
+	var buf bytes.Buffer
+	_, err := d.WriteTo(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "de", buf.String())
+
+	l := NewList()
+	assert.Equal(t, ErrNil, l.Append(NewInt(1), nil))
+	assert.Equal(t, 0, l.Len())
+	// NewList去掉nil元素，编码和转换都不会panic
+	nl := NewList(NewInt(1), nil)
+	assert.Equal(t, 1, nl.Len())
+	buf.Reset()
+	_, err = nl.WriteTo(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "li1ee", buf.String())
+	assert.Equal(t, 1, len(ToValue(NewList(nil, NewInt(1)), JSONOptions{}).([]interface{})))
+	buf.Reset()
+	assert.Equal(t, nil, Dump(&buf, NewList(nil), JSONOptions{}))
+}
@@ -1,48 +1,67 @@
 package bencode
 
 import (
-	"bufio"
+	"fmt"
 	"io"
+	"math/big"
+	"strconv"
+	"strings"
 )
 
+// Parse 从r中解析出一个BObject
+// r如果不是*bufio.Reader，会被包装一层，此时r中该值之后的数据可能被多读，需要连续读取多个值请使用Decoder
 func Parse(r io.Reader) (*BObject, error) {
-	br := bufio.NewReader(r)
+	return NewDecoder(r).Parse()
+}
+
+func (d *Decoder) parse(depth int) (*BObject, error) {
 	// 查看第一个字符
-	b, err := br.Peek(1)
+	b, err := d.peek()
 	if err != nil {
-		return nil, err
+		// 顶层的值之前没有数据说明流正常结束，否则是被截断了
+		if err == io.EOF && depth == 0 {
+			return nil, io.EOF
+		}
+		return nil, d.ioError(err)
 	}
-	var ret BObject
+	ret := BObject{begin: d.off - d.start}
 	switch {
-	case b[0] >= '0' && b[0] <= '9':
-		val, err := DecodeString(br)
+	case checkNum(b):
+		val, err := d.readString()
 		if err != nil {
 			return nil, err
 		}
 		ret.type_ = BSTR
 		ret.val_ = val
-	case b[0] == 'i':
-		val, err := DecodeInt(br)
+	case b == 'i':
+		val, err := d.readInt()
 		if err != nil {
 			return nil, err
 		}
 		ret.type_ = BINT
 		ret.val_ = val
-	case b[0] == 'l':
+	case b == 'l':
+		if err = d.checkDepth(depth); err != nil {
+			return nil, err
+		}
 		// 读取掉l
-		if _, err = br.ReadByte(); err != nil {
+		if _, err = d.readByte(); err != nil {
 			return nil, err
 		}
 		list := make([]*BObject, 0)
 		for {
-			if p, _ := br.Peek(1); p[0] == 'e' {
-				if _, err = br.ReadByte(); err != nil {
-					return nil, err
-				}
+			end, err := d.tryEnd()
+			if err != nil {
+				return nil, err
+			}
+			if end {
 				break
 			}
+			if err = d.countElem(); err != nil {
+				return nil, err
+			}
 			// 递归下降
-			elem, err := Parse(br)
+			elem, err := d.parse(depth + 1)
 			if err != nil {
 				return nil, err
 			}
@@ -50,23 +69,30 @@ func Parse(r io.Reader) (*BObject, error) {
 		}
 		ret.type_ = BLIST
 		ret.val_ = list
-	case b[0] == 'd':
-		if _, err = br.ReadByte(); err != nil {
+	case b == 'd':
+		if err = d.checkDepth(depth); err != nil {
+			return nil, err
+		}
+		if _, err = d.readByte(); err != nil {
 			return nil, err
 		}
 		dict := make(map[string]*BObject)
 		for {
-			if p, _ := br.Peek(1); p[0] == 'e' {
-				if _, err = br.ReadByte(); err != nil {
-					return nil, err
-				}
+			end, err := d.tryEnd()
+			if err != nil {
+				return nil, err
+			}
+			if end {
 				break
 			}
-			key, err := DecodeString(br)
+			if err = d.countElem(); err != nil {
+				return nil, err
+			}
+			key, err := d.readString()
 			if err != nil {
 				return nil, err
 			}
-			val, err := Parse(br)
+			val, err := d.parse(depth + 1)
 			if err != nil {
 				return nil, err
 			}
@@ -75,7 +101,226 @@ func Parse(r io.Reader) (*BObject, error) {
 		ret.type_ = BDICT
 		ret.val_ = dict
 	default:
-		return nil, ErrIvd
+		return nil, d.syntaxError(ErrIvd)
 	}
+	ret.end = d.off - d.start
 	return &ret, nil
 }
+
+// readByte 读一个字节并推进偏移，EOF转换成带位置的SyntaxError
+func (d *Decoder) readByte() (byte, error) {
+	if err := d.checkSize(1); err != nil {
+		return 0, err
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.ioError(err)
+	}
+	d.off++
+	if d.rec {
+		d.raw = append(d.raw, b)
+	}
+	return b, nil
+}
+
+func (d *Decoder) limitError(err error) error {
+	return fmt.Errorf("bencode: %w at offset %d", err, d.off)
+}
+
+// checkSize 再读n个字节是否会超出MaxInputSize
+func (d *Decoder) checkSize(n int64) error {
+	if d.limits.MaxInputSize > 0 && d.off-d.start+n > d.limits.MaxInputSize {
+		return d.limitError(ErrInputTooLarge)
+	}
+	return nil
+}
+
+func (d *Decoder) checkDepth(depth int) error {
+	if d.limits.MaxDepth > 0 && depth >= d.limits.MaxDepth {
+		return d.limitError(ErrTooDeep)
+	}
+	return nil
+}
+
+func (d *Decoder) countElem() error {
+	d.elems++
+	if d.limits.MaxElements > 0 && d.elems > d.limits.MaxElements {
+		return d.limitError(ErrTooManyElements)
+	}
+	return nil
+}
+
+// unreadByte 只能在readByte成功之后调用
+func (d *Decoder) unreadByte() {
+	_ = d.r.UnreadByte()
+	d.off--
+	if d.rec {
+		d.raw = d.raw[:len(d.raw)-1]
+	}
+}
+
+// peek 查看下一个字符但不读取
+func (d *Decoder) peek() (byte, error) {
+	p, err := d.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+func (d *Decoder) syntaxError(err error) error {
+	return &SyntaxError{Offset: d.off, Err: err}
+}
+
+// ioError 值读到一半遇到EOF说明数据被截断，其余的io错误原样返回
+func (d *Decoder) ioError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return d.syntaxError(io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// tryEnd 列表和字典内部使用，遇到e时读掉并返回true
+func (d *Decoder) tryEnd() (bool, error) {
+	b, err := d.peek()
+	if err != nil {
+		return false, d.ioError(err)
+	}
+	if b != 'e' {
+		return false, nil
+	}
+	_, err = d.readByte()
+	return true, err
+}
+
+// readDigits 读取连续的数字，allowSign为true时允许开头的负号
+func (d *Decoder) readDigits(allowSign bool) (string, error) {
+	sb := strings.Builder{}
+	b, err := d.readByte()
+	if err != nil {
+		return "", err
+	}
+	// 正负数标志
+	if allowSign && b == '-' {
+		sb.WriteByte(b)
+		if b, err = d.readByte(); err != nil {
+			return "", err
+		}
+	}
+	for checkNum(b) {
+		sb.WriteByte(b)
+		if b, err = d.readByte(); err != nil {
+			return "", err
+		}
+	}
+	d.unreadByte()
+	return sb.String(), nil
+}
+
+// readDecimal 读取字符串的长度前缀
+func (d *Decoder) readDecimal() (int, error) {
+	start := d.off
+	digits, err := d.readDigits(false)
+	if err != nil {
+		return 0, err
+	}
+	val, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, &SyntaxError{Offset: start, Err: ErrNum}
+	}
+	return val, nil
+}
+
+// 小于这个长度的字符串一次性分配
+const stringChunk = 64 << 10
+
+func (d *Decoder) readString() (string, error) {
+	start := d.off
+	// 将冒号之前的表示的数字读出来
+	num, err := d.readDecimal()
+	if err != nil {
+		return "", err
+	}
+	if num < 0 {
+		return "", &SyntaxError{Offset: start, Err: ErrNum}
+	}
+	// 读冒号
+	b, err := d.readByte()
+	if err != nil {
+		return "", err
+	}
+	if b != ':' {
+		d.unreadByte()
+		return "", d.syntaxError(ErrCol)
+	}
+	// 长度来自输入，先检查限制再读，避免按照伪造的长度直接分配内存
+	if d.limits.MaxStringLen > 0 && num > d.limits.MaxStringLen {
+		return "", d.limitError(ErrStringTooLong)
+	}
+	if err = d.checkSize(int64(num)); err != nil {
+		return "", err
+	}
+	// 读取接下来的字符串，边读边扩容，数据不够时不会多分配
+	sb := strings.Builder{}
+	if num <= stringChunk {
+		sb.Grow(num)
+	}
+	n, err := io.CopyN(&sb, d.r, int64(num))
+	d.off += n
+	if err != nil {
+		return "", d.ioError(err)
+	}
+	if d.rec {
+		d.raw = append(d.raw, sb.String()...)
+	}
+	return sb.String(), nil
+}
+
+// readInt 返回int64，超出范围时如果开启了UseBigInt返回*big.Int，否则返回ErrOverflow
+func (d *Decoder) readInt() (BValue, error) {
+	b, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if b != 'i' {
+		d.unreadByte()
+		return nil, d.syntaxError(ErrEpI)
+	}
+	start := d.off
+	digits, err := d.readDigits(true)
+	if err != nil {
+		return nil, err
+	}
+	if !validInt(digits) {
+		return nil, &SyntaxError{Offset: start, Err: ErrNum}
+	}
+	var val BValue
+	if v, err := strconv.ParseInt(digits, 10, 64); err == nil {
+		val = v
+	} else if d.useBig {
+		// 格式已经校验过，这里只可能是超出了int64的范围
+		val, _ = new(big.Int).SetString(digits, 10)
+	} else {
+		return nil, fmt.Errorf("bencode: %w at offset %d", ErrOverflow, start)
+	}
+	if b, err = d.readByte(); err != nil {
+		return nil, err
+	}
+	if b != 'e' {
+		d.unreadByte()
+		return nil, d.syntaxError(ErrEpE)
+	}
+	return val, nil
+}
+
+// validInt 规范里整数不能为空，不能有前导0，也不能是-0
+func validInt(digits string) bool {
+	abs := strings.TrimPrefix(digits, "-")
+	if abs == "" {
+		return false
+	}
+	if abs[0] == '0' {
+		return abs == "0" && abs == digits
+	}
+	return true
+}
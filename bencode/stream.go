@@ -0,0 +1,120 @@
+package bencode
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+)
+
+// Decoder 从输入流中依次读取bencode值
+// 所有层级的解析共享同一个bufio.Reader，多个首尾相连的值可以通过多次调用Decode读出
+type Decoder struct {
+	r      *bufio.Reader
+	off    int64 // 已经读取的字节数，用于报错定位
+	strict bool  // 字典中出现结构体没有的字段时报错
+	useBig bool  // 超出int64的整数用*big.Int保存
+	limits Limits
+	start  int64 // 当前值开始的偏移
+	elems  int   // 当前值里已经读到的元素个数
+	rec    bool  // Decode期间记录读过的原始字节，用于填充RawMessage
+	raw    []byte
+}
+
+// Limits 解码时允许消耗的资源上限，输入来自tracker或peer等不可信来源时防止耗尽内存和栈
+// 每一项都是针对单个顶层值的，为0表示不限制
+type Limits struct {
+	MaxStringLen int   // 单个字符串的最大长度
+	MaxInputSize int64 // 单个值编码后的最大字节数
+	MaxDepth     int   // 列表和字典的最大嵌套层数
+	MaxElements  int   // 列表元素和字典项的总数
+}
+
+// DefaultLimits Parse, Unmarshal和NewDecoder默认使用的限制，足够容纳上百GB内容的种子文件
+var DefaultLimits = Limits{
+	MaxStringLen: 32 << 20,
+	MaxInputSize: 64 << 20,
+	MaxDepth:     256,
+	MaxElements:  1 << 22,
+}
+
+// NewDecoder r如果已经是*bufio.Reader则直接复用
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br, limits: DefaultLimits}
+}
+
+// SetLimits 替换默认的资源限制，传入Limits{}表示完全不限制
+func (d *Decoder) SetLimits(l Limits) {
+	d.limits = l
+}
+
+// DisallowUnknownFields 开启严格模式，反序列化到结构体时遇到未知的key返回ErrUnknownField
+func (d *Decoder) DisallowUnknownFields() {
+	d.strict = true
+}
+
+// UseBigInt 超出int64范围的整数不再报ErrOverflow，而是以*big.Int保存在BObject中
+// 反序列化时可以写入big.Int或*big.Int类型的字段
+func (d *Decoder) UseBigInt() {
+	d.useBig = true
+}
+
+// InputOffset 返回当前已经消费的字节数
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// Parse 读取下一个值，输入已经读完时返回io.EOF
+func (d *Decoder) Parse() (*BObject, error) {
+	d.start, d.elems = d.off, 0
+	return d.parse(0)
+}
+
+// Decode 读取下一个值并写入v，v必须是非nil指针
+// v为*BObject时直接保存解析结果，否则按照bencode tag反序列化，输入已经读完时返回io.EOF
+func (d *Decoder) Decode(v interface{}) error {
+	p := reflect.ValueOf(v)
+	if p.Kind() != reflect.Ptr || p.IsNil() {
+		return errors.New("dest must be a pointer")
+	}
+	d.rec, d.raw = true, nil
+	defer func() {
+		d.rec, d.raw = false, nil
+	}()
+	o, err := d.Parse()
+	if err != nil {
+		return err
+	}
+	return d.unmarshal(p.Elem(), o, "")
+}
+
+// Encoder 将值以bencode格式写入输出流
+type Encoder struct {
+	w *bufio.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode 写入v的bencode编码，v可以是BObject或者string, int, slice, struct及其指针
+// 每次调用结束都会flush，出错时返回第一个遇到的错误
+func (e *Encoder) Encode(v interface{}) error {
+	var err error
+	switch o := v.(type) {
+	case *BObject:
+		_, err = o.writeTo(e.w)
+	case BObject:
+		_, err = o.writeTo(e.w)
+	default:
+		_, err = marshalValue(e.w, reflect.ValueOf(v))
+	}
+	if err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
@@ -0,0 +1,79 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestDecoderMultiValue(t *testing.T) {
+	in := "d4:name6:archer3:agei29eed4:name5:nancy3:agei31eei7e"
+	dec := NewDecoder(bytes.NewBufferString(in))
+	u := &User{}
+	assert.Equal(t, nil, dec.Decode(u))
+	assert.Equal(t, "archer", u.Name)
+	assert.Equal(t, 29, u.Age)
+	assert.Equal(t, nil, dec.Decode(u))
+	assert.Equal(t, "nancy", u.Name)
+	assert.Equal(t, 31, u.Age)
+
+	var o BObject
+	assert.Equal(t, nil, dec.Decode(&o))
+	objAssertInt(t, 7, &o)
+	assert.Equal(t, io.EOF, dec.Decode(&o))
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	for _, in := range []string{"li1e", "d3:key", "5:abc", "i12"} {
+		_, err := NewDecoder(bytes.NewBufferString(in)).Parse()
+		assert.NotEqual(t, nil, err, in)
+	}
+	_, err := NewDecoder(bytes.NewBufferString("li1e")).Parse()
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestEncoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	assert.Equal(t, nil, enc.Encode(&User{"archer", 29}))
+	assert.Equal(t, nil, enc.Encode([]int{1, 2}))
+	assert.Equal(t, "d3:agei29e4:name6:archereli1ei2ee", buf.String())
+
+	o, err := Parse(bytes.NewBufferString("d1:bi2e1:ai1ee"))
+	assert.Equal(t, nil, err)
+	buf.Reset()
+	assert.Equal(t, nil, enc.Encode(o))
+	assert.Equal(t, "d1:ai1e1:bi2ee", buf.String())
+
+	assert.NotEqual(t, nil, enc.Encode(map[int]bool{}))
+	assert.NotEqual(t, nil, NewEncoder(failWriter{}).Encode(&User{"archer", 29}))
+}
+
+type rawTorrent struct {
+	Announce string     `bencode:"announce"`
+	Info     RawMessage `bencode:"info"`
+}
+
+func TestRawMessage(t *testing.T) {
+	// info里的key没有排序，重新编码会得到不同的字节，RawMessage必须保留原样
+	info := "d4:name1:n6:lengthi5ee"
+	in := "d8:announce3:url4:info" + info + "e"
+	r := &rawTorrent{}
+	dec := NewDecoder(bytes.NewBufferString(in + in))
+	assert.Equal(t, nil, dec.Decode(r))
+	assert.Equal(t, info, string(r.Info))
+	assert.Equal(t, nil, dec.Decode(r))
+	assert.Equal(t, info, string(r.Info))
+
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(r))
+	assert.Equal(t, in, buf.String())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"go-torrent/bencode"
+	"io"
+	"log"
+	"os"
+)
+
+const usage = `usage: bencode <command> [flags] [file]
+
+commands:
+  dump       print the structure of a bencoded file, one value per line
+  pretty     print bencode as indented JSON, large hash blobs elided
+  to-json    convert bencode to JSON that from-json can turn back into identical bencode
+  to-yaml    convert bencode to YAML
+  from-json  convert JSON produced by to-json back to bencode
+
+input is read from file, or stdin when file is omitted or "-"
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	b64 := fs.Bool("base64", false, "render binary strings as base64 instead of hex")
+	full := fs.Bool("full", false, "dump/pretty: do not elide pieces and piece layers")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage+"\nflags:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(os.Args[2:])
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out := bufio.NewWriter(os.Stdout)
+	defer func() {
+		_ = out.Flush()
+	}()
+
+	opt := bencode.JSONOptions{Base64: *b64}
+	switch cmd {
+	case "dump":
+		opt.Elide = !*full
+		err = withObject(in, func(o *bencode.BObject) error {
+			return bencode.Dump(out, o, opt)
+		})
+	case "pretty":
+		opt.Elide = !*full
+		err = withObject(in, func(o *bencode.BObject) error {
+			return bencode.ToJSON(out, o, opt, true)
+		})
+	case "to-json":
+		err = withObject(in, func(o *bencode.BObject) error {
+			return bencode.ToJSON(out, o, opt, false)
+		})
+	case "to-yaml":
+		err = withObject(in, func(o *bencode.BObject) error {
+			return bencode.ToYAML(out, o, opt)
+		})
+	case "from-json":
+		var o *bencode.BObject
+		if o, err = bencode.FromJSON(in); err == nil {
+			_, err = o.WriteTo(out)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		_ = out.Flush()
+		log.Fatalln(err)
+	}
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// withObject 依次处理输入中首尾相连的每一个bencode值，如tracker的多段回复
+func withObject(r io.Reader, fn func(o *bencode.BObject) error) error {
+	dec := bencode.NewDecoder(r)
+	dec.UseBigInt()
+	for {
+		o, err := dec.Parse()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(o); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go-torrent/torrent"
+	"io"
+	"log"
+	"os"
+)
+
+// runCat 边下载边把一个文件按顺序写到标准输出，可以直接接到其他工具
+func runCat(args []string) {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	dir := fs.String("dir", ".", "download directory")
+	sel := fs.String("file", "0", "the file to write: index as listed by info or a glob pattern")
+	verbose := fs.Bool("v", false, "print log lines instead of the progress view")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalln("usage: go-torrent cat [-dir dir] [-file index|glob] [-v] <file.torrent>")
+	}
+	if err := cat(fs.Arg(0), *dir, *sel, *verbose); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// cat 出错时返回，保证关闭Reader、发送stopped等清理都能执行
+func cat(path, dir, sel string, verbose bool) error {
+	tf, task, err := loadTask(path)
+	if err != nil {
+		return err
+	}
+	prio, err := selectFiles(tf.Files, sel)
+	if err != nil {
+		return err
+	}
+	target := -1
+	for i, p := range prio {
+		if p != torrent.PrioritySkip {
+			if target >= 0 {
+				return fmt.Errorf("%q matches more than one file", sel)
+			}
+			target = i
+		}
+	}
+	task.Dir = dir
+	task.Sequential = true
+	task.Priorities = prio
+
+	ctx, stop := signalContext()
+	defer stop()
+	r := task.NewReader()
+	defer func() {
+		_ = r.Close()
+	}()
+	// 标准输出是文件内容，进度显示在标准错误
+	pg := startProgress(os.Stderr, tf, task, verbose)
+	if !findPeers(ctx, tf, task) {
+		pg.stop()
+		return errors.New("can not find peers")
+	}
+	// 中断时Download停止，阻塞的读取随之返回
+	done := make(chan error, 1)
+	go func() {
+		done <- torrent.Download(ctx, task)
+	}()
+	f := tf.Files[target]
+	_, err = io.Copy(os.Stdout, io.NewSectionReader(r, int64(f.Offset), int64(f.Length)))
+	// 文件已经读完或者出错，停止下载并等数据刷到磁盘
+	interrupted := ctx.Err() != nil
+	stop()
+	derr := <-done
+	pg.stop()
+	if interrupted {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if derr != nil && derr != context.Canceled {
+		return derr
+	}
+	return nil
+}
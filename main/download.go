@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go-torrent/torrent"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func runDownload(args []string) {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	var opts downloadOpts
+	fs.StringVar(&opts.dir, "dir", ".", "download directory")
+	fs.StringVar(&opts.sel, "select", "", "only download these files: indexes as listed by info or glob patterns, separated by ','")
+	fs.StringVar(&opts.priority, "priority", "", "file priorities as file=skip|low|normal|high, files given like -select, separated by ','")
+	fs.BoolVar(&opts.sequential, "sequential", false, "download pieces in order so files can be used while downloading")
+	fs.BoolVar(&opts.verbose, "v", false, "print log lines instead of the progress view")
+	downLimit := fs.String("down-limit", "", "download rate limit in bytes per second, K/M/G suffixes allowed")
+	upLimit := fs.String("up-limit", "", "upload rate limit in bytes per second, K/M/G suffixes allowed; only protocol messages are sent until seeding is supported")
+	fs.StringVar(&opts.banFile, "ban-file", "", "file to keep ips banned for sending corrupt data")
+	fs.StringVar(&opts.blockFile, "blocklist", "", "ip blocklist in P2P or DAT format")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalln("usage: go-torrent download [-dir dir] [-select 0,2,*.mkv] [-priority *.nfo=low] [-sequential] [-down-limit 1M] [-up-limit 100K] [-ban-file bans.txt] [-blocklist list.p2p] [-v] <file.torrent>")
+	}
+	opts.down, opts.up = parseRate(*downLimit), parseRate(*upLimit)
+	if err := download(fs.Arg(0), opts); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+type downloadOpts struct {
+	dir, sel, priority  string
+	sequential, verbose bool
+	down, up            int
+	banFile, blockFile  string
+}
+
+// download 出错时返回而不是直接退出，保证关闭封禁列表、发送stopped等清理都能执行
+func download(path string, opts downloadOpts) error {
+	tf, task, err := loadTask(path)
+	if err != nil {
+		return err
+	}
+	task.Dir = opts.dir
+	task.Sequential = opts.sequential
+	task.SetDownloadLimit(opts.down)
+	task.SetUploadLimit(opts.up)
+	if opts.sel != "" {
+		if task.Priorities, err = selectFiles(tf.Files, opts.sel); err != nil {
+			return err
+		}
+	}
+	if opts.priority != "" {
+		if task.Priorities, err = setPriorities(tf.Files, task.Priorities, opts.priority); err != nil {
+			return err
+		}
+	}
+	bans, blocklist, err := loadBans(opts.banFile, opts.blockFile)
+	if err != nil {
+		return err
+	}
+	defer closeBans(bans)
+	task.Bans, task.Blocklist = bans, blocklist
+	ctx, stop := signalContext()
+	defer stop()
+	pg := startProgress(os.Stdout, tf, task, opts.verbose)
+	if !findPeers(ctx, tf, task) {
+		pg.stop()
+		return errors.New("can not find peers")
+	}
+	err = torrent.Download(ctx, task)
+	pg.stop()
+	if err != nil && ctx.Err() != nil {
+		log.Println("interrupted, downloaded data has been saved")
+		return nil
+	}
+	return err
+}
+
+// parseRate 解析限速，比如"500K"，单位是1024，空字符串表示不限速
+func parseRate(s string) int {
+	if s == "" {
+		return 0
+	}
+	mult := 1.0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		log.Fatalf("invalid rate limit: %q\n", s)
+	}
+	return int(n * mult)
+}
+
+// loadBans 路径为空时返回nil，由任务自己创建不保存的封禁列表
+func loadBans(banFile, blockFile string) (*torrent.BanList, *torrent.Blocklist, error) {
+	var bans *torrent.BanList
+	var blocklist *torrent.Blocklist
+	var err error
+	if blockFile != "" {
+		f, err := os.Open(blockFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocklist, err = torrent.LoadBlocklist(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("load %s: %w", blockFile, err)
+		}
+		log.Printf("loaded %d blocked ranges\n", blocklist.Len())
+	}
+	// 最后打开，前面出错时不需要关闭
+	if banFile != "" {
+		if bans, err = torrent.OpenBanList(banFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return bans, blocklist, nil
+}
+
+func closeBans(bans *torrent.BanList) {
+	if bans != nil {
+		_ = bans.Close()
+	}
+}
+
+// signalContext 收到SIGINT或SIGTERM时取消
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// loadTask 解析种子生成任务，peer由findPeers获取
+func loadTask(path string) (*torrent.TorrentFile, *torrent.TorrentTask, error) {
+	tf, err := openTorrent(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var peerId [torrent.IDLEN]byte
+	// 本地客户端的唯一标识，随机生成
+	_, _ = rand.Read(peerId[:])
+	task := torrent.NewTask(tf, peerId, nil)
+	// Download期间定期重新汇报，结束时发送stopped
+	task.Tracker = tf
+	return tf, task, nil
+}
+
+// findPeers 从tracker获取peer，有web seed时没有peer也可以下载
+// 在startProgress之后调用，tracker的结果会显示出来
+func findPeers(ctx context.Context, tf *torrent.TorrentFile, task *torrent.TorrentTask) bool {
+	task.PeerList = task.Announce(ctx, tf, torrent.EventStarted)
+	return len(task.PeerList) > 0 || len(tf.URLList) > 0
+}
+
+func openTorrent(path string) (*torrent.TorrentFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	tf, err := torrent.ParseFile(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return tf, nil
+}
+
+// selectFiles 选中的文件正常下载，其余跳过
+func selectFiles(files []torrent.FileInfo, spec string) ([]torrent.Priority, error) {
+	prio := make([]torrent.Priority, len(files))
+	for _, item := range splitList(spec, ",") {
+		idxs, err := matchFiles(files, item)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range idxs {
+			prio[i] = torrent.PriorityNormal
+		}
+	}
+	return prio, nil
+}
+
+// setPriorities 按"文件=优先级"修改prio，多项用逗号分隔，比如"*.mkv=high,*.nfo=low"，prio为空时其余文件是normal
+func setPriorities(files []torrent.FileInfo, prio []torrent.Priority, spec string) ([]torrent.Priority, error) {
+	if prio == nil {
+		prio = make([]torrent.Priority, len(files))
+		for i := range prio {
+			prio[i] = torrent.PriorityNormal
+		}
+	}
+	for _, item := range splitList(spec, ",") {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid priority %q, want file=priority", item)
+		}
+		p, err := torrent.ParsePriority(item[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		idxs, err := matchFiles(files, item[:i])
+		if err != nil {
+			return nil, err
+		}
+		for _, idx := range idxs {
+			prio[idx] = p
+		}
+	}
+	return prio, nil
+}
+
+// matchFiles 序号和info命令列出的一致(不包含填充文件)，通配符匹配完整路径、去掉顶层目录的路径或者文件名
+func matchFiles(files []torrent.FileInfo, item string) ([]int, error) {
+	var visible []int
+	for i, f := range files {
+		if !f.Padding {
+			visible = append(visible, i)
+		}
+	}
+	if n, err := strconv.Atoi(item); err == nil {
+		if n < 0 || n >= len(visible) {
+			return nil, fmt.Errorf("file index %d out of range", n)
+		}
+		return []int{visible[n]}, nil
+	}
+	var ret []int
+	for _, i := range visible {
+		p := files[i].Path
+		for _, name := range []string{strings.Join(p, "/"), strings.Join(p[1:], "/"), p[len(p)-1]} {
+			ok, err := path.Match(item, name)
+			if err != nil {
+				return nil, err
+			}
+			if ok && name != "" {
+				ret = append(ret, i)
+				break
+			}
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no file matches %q", item)
+	}
+	return ret, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"go-torrent/bencode"
+	"go-torrent/torrent"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func runEdit(args []string) {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	out := fs.String("o", "", "output file, - for stdout (required)")
+	announce := fs.String("announce", "", "set the announce url, empty removes it")
+	announceList := fs.String("announce-list", "", "set tiers of trackers: urls in a tier separated by ',', tiers by '|'; empty removes it")
+	comment := fs.String("comment", "", "set the comment, empty removes it")
+	urlList := fs.String("url-list", "", "set web seeds separated by ','; empty removes it")
+	changeInfo := fs.Bool("change-info", false, "allow -name and -private, which change the info hash")
+	name := fs.String("name", "", "rename the torrent (info field)")
+	private := fs.Bool("private", false, "set or strip the private flag (info field)")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *out == "" {
+		log.Fatalln("usage: go-torrent edit -o <output> [flags] <file.torrent>")
+	}
+	// 只处理显式传入的参数，空字符串表示删除
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if (set["name"] || set["private"]) && !*changeInfo {
+		log.Fatalln("-name and -private change the info dict and therefore the info hash, pass -change-info to confirm")
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	m, err := torrent.LoadMetainfo(file)
+	_ = file.Close()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	before := m.InfoSHA()
+	if set["announce"] {
+		err = m.SetAnnounce(*announce)
+	}
+	if err == nil && set["announce-list"] {
+		err = m.SetAnnounceList(parseTiers(*announceList))
+	}
+	if err == nil && set["comment"] {
+		err = m.SetComment(*comment)
+	}
+	if err == nil && set["url-list"] {
+		err = m.SetURLList(splitList(*urlList, ","))
+	}
+	if err == nil && (set["name"] || set["private"]) {
+		err = m.EditInfo(func(info *bencode.BObject) error {
+			if set["name"] {
+				if *name == "" {
+					return errors.New("name cannot be empty")
+				}
+				_ = info.Set("name", bencode.NewString(*name))
+			}
+			if set["private"] {
+				if *private {
+					return info.Set("private", bencode.NewInt(1))
+				}
+				return info.Delete("private")
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if after := m.InfoSHA(); after != before {
+		log.Printf("warning: info hash changed from %s to %s, this is a new torrent for trackers and peers\n",
+			hex.EncodeToString(before[:]), hex.EncodeToString(after[:]))
+	}
+	if err = writeOutput(*out, m); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func writeOutput(path string, m io.WriterTo) error {
+	if path == "-" {
+		_, err := m.WriteTo(os.Stdout)
+		return err
+	}
+	// 先写临时文件再替换，输出和输入是同一个文件时也不会写坏
+	tmp := path + ".tmp" + strconv.Itoa(os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = m.WriteTo(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// parseTiers 解析a,b|c形式的tracker分层
+func parseTiers(s string) [][]string {
+	var tiers [][]string
+	for _, tier := range splitList(s, "|") {
+		if urls := splitList(tier, ","); len(urls) > 0 {
+			tiers = append(tiers, urls)
+		}
+	}
+	return tiers
+}
+
+func splitList(s, sep string) []string {
+	var ret []string
+	for _, part := range strings.Split(s, sep) {
+		if part = strings.TrimSpace(part); part != "" {
+			ret = append(ret, part)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-torrent/torrent"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// torrentInfo info命令输出的内容，--json时直接序列化
+type torrentInfo struct {
+	Name         string     `json:"name"`
+	Version      string     `json:"version"`             // v1，v2或者hybrid
+	InfoHash     string     `json:"info_hash,omitempty"` // 纯v2种子没有v1的info hash
+	InfoHashV2   string     `json:"info_hash_v2,omitempty"`
+	TotalSize    int        `json:"total_size"`
+	PieceLength  int        `json:"piece_length"`
+	PieceCount   int        `json:"piece_count"`
+	Private      bool       `json:"private"`
+	Trackers     [][]string `json:"trackers"`
+	WebSeeds     []string   `json:"web_seeds"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	Source       string     `json:"source,omitempty"`
+	Files        []fileInfo `json:"files"`
+}
+
+type fileInfo struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+}
+
+func runInfo(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print as JSON for scripting")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalln("usage: go-torrent info [--json] <file.torrent>")
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	info, err := loadInfo(data)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(info)
+	} else {
+		err = printInfo(os.Stdout, info)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func loadInfo(data []byte) (*torrentInfo, error) {
+	tf, err := torrent.ParseFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	info := &torrentInfo{
+		Name:        tf.FileName,
+		Version:     "v1",
+		TotalSize:   tf.FileLen,
+		PieceLength: tf.PieceLen,
+		PieceCount:  tf.PieceCount(),
+		Private:     tf.Private,
+		CreatedBy:   tf.CreatedBy,
+		Comment:     tf.Comment,
+		Source:      tf.Source,
+		Trackers:    tf.AnnounceList,
+		WebSeeds:    append(append([]string{}, tf.URLList...), tf.HTTPSeeds...),
+	}
+	if !tf.IsV2() || tf.IsHybrid() {
+		info.InfoHash = hex.EncodeToString(tf.InfoSHA[:])
+	}
+	if tf.IsV2() {
+		info.Version = "v2"
+		if tf.IsHybrid() {
+			info.Version = "hybrid"
+		}
+		info.InfoHashV2 = hex.EncodeToString(tf.InfoSHA256[:])
+	}
+	if !tf.CreationDate.IsZero() {
+		t := tf.CreationDate.UTC()
+		info.CreationDate = &t
+	}
+	// 没有announce-list时只有一个tracker
+	if len(info.Trackers) == 0 && tf.Announce != "" {
+		info.Trackers = [][]string{{tf.Announce}}
+	}
+	if info.Trackers == nil {
+		info.Trackers = [][]string{}
+	}
+	for _, f := range tf.Files {
+		// 填充文件只是为了对齐，不展示
+		if f.Padding {
+			continue
+		}
+		info.Files = append(info.Files, fileInfo{Path: strings.Join(f.Path, "/"), Length: f.Length})
+	}
+	return info, nil
+}
+
+func printInfo(w io.Writer, info *torrentInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "Name:\t%s\n", info.Name)
+	_, _ = fmt.Fprintf(tw, "Version:\t%s\n", info.Version)
+	if info.InfoHash != "" {
+		_, _ = fmt.Fprintf(tw, "Info hash:\t%s\n", info.InfoHash)
+	}
+	if info.InfoHashV2 != "" {
+		_, _ = fmt.Fprintf(tw, "Info hash v2:\t%s\n", info.InfoHashV2)
+	}
+	_, _ = fmt.Fprintf(tw, "Total size:\t%s (%d bytes)\n", formatSize(int64(info.TotalSize)), info.TotalSize)
+	_, _ = fmt.Fprintf(tw, "Pieces:\t%d x %s\n", info.PieceCount, formatSize(int64(info.PieceLength)))
+	_, _ = fmt.Fprintf(tw, "Private:\t%s\n", yesNo(info.Private))
+	if info.CreatedBy != "" {
+		_, _ = fmt.Fprintf(tw, "Created by:\t%s\n", info.CreatedBy)
+	}
+	if info.CreationDate != nil {
+		_, _ = fmt.Fprintf(tw, "Creation date:\t%s\n", info.CreationDate.Format(time.RFC3339))
+	}
+	if info.Comment != "" {
+		_, _ = fmt.Fprintf(tw, "Comment:\t%s\n", info.Comment)
+	}
+	if info.Source != "" {
+		_, _ = fmt.Fprintf(tw, "Source:\t%s\n", info.Source)
+	}
+	for i, tier := range info.Trackers {
+		label := ""
+		if i == 0 {
+			label = "Trackers:"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\ttier %d: %s\n", label, i+1, strings.Join(tier, ", "))
+	}
+	for i, seed := range info.WebSeeds {
+		label := ""
+		if i == 0 {
+			label = "Web seeds:"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\n", label, seed)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "Files (%d):\n", len(info.Files))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for i, f := range info.Files {
+		_, _ = fmt.Fprintf(tw, "  %d\t  %s\t  %s\t\n", i, formatSize(int64(f.Length)), f.Path)
+	}
+	return tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// formatSize 以1024为单位转换成便于阅读的大小
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,44 +1,45 @@
 package main
 
 import (
-	"bufio"
-	"go-torrent/torrent"
-	"log"
-	"math/rand"
+	"fmt"
 	"os"
 )
 
+const usage = `usage: go-torrent <command> [flags] <file.torrent>
+
+commands:
+  download  download the torrent into the current directory (default)
+  info      print metadata of a torrent file
+  verify    check downloaded data against the piece hashes of a torrent
+  edit      change trackers, comment or web seeds of a torrent without touching its info hash
+  cat       write one file of the torrent to stdout while it is downloading
+  serve     download torrents and serve their files over HTTP with Range support
+
+run "go-torrent <command> -h" for the flags of a command
+`
+
 func main() {
-	file, err := os.Open(os.Args[1])
-	if err != nil {
-		log.Fatalln("open file error")
-		return
-	}
-	defer func() {
-		_ = file.Close()
-	}()
-	tf, err := torrent.ParseFile(bufio.NewReader(file))
-	if err != nil {
-		log.Fatalln("parse file error")
-		return
-	}
-	var peerId [torrent.IDLEN]byte
-	// 本地客户端的唯一标识，随机生成
-	_, _ = rand.Read(peerId[:])
-	// 找到所有下载地址
-	peers := torrent.FindPeers(tf, peerId)
-	if len(peers) == 0 {
-		log.Fatalln("can not find peers")
-		return
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
-	task := &torrent.TorrentTask{
-		PeerId:   peerId,
-		PeerList: peers,
-		InfoSHA:  tf.InfoSHA,
-		FileName: tf.FileName,
-		FileLen:  tf.FileLen,
-		PieceLen: tf.PieceLen,
-		PieceSHA: tf.PieceSHA,
+	switch os.Args[1] {
+	case "download":
+		runDownload(os.Args[2:])
+	case "info":
+		runInfo(os.Args[2:])
+	case "verify":
+		runVerify(os.Args[2:])
+	case "edit":
+		runEdit(os.Args[2:])
+	case "cat":
+		runCat(os.Args[2:])
+	case "serve":
+		runServe(os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		// 兼容之前直接传种子路径的用法
+		runDownload(os.Args[1:])
 	}
-	_ = torrent.Download(task)
 }
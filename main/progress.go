@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-torrent/torrent"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	barWidth = 50
+	// 不是终端时输出一行进度的间隔
+	plainInterval = 10 * time.Second
+)
+
+// progress 下载时在终端显示一个刷新的状态，输出不是终端时定期打印一行
+type progress struct {
+	out     *os.File
+	tty     bool
+	name    string
+	pieces  int
+	task    *torrent.TorrentTask
+	tracker string    // 最近一次tracker汇报的结果
+	lines   int       // 上次输出的行数，刷新时覆盖
+	printed time.Time // 上次输出一行的时间
+	cancel  func()
+	done    chan struct{}
+}
+
+// startProgress 在Download之前调用，verbose时不显示进度，保留原来的日志
+// 显示期间日志会干扰刷新，先丢弃，stop之后恢复
+func startProgress(out *os.File, tf *torrent.TorrentFile, task *torrent.TorrentTask, verbose bool) *progress {
+	p := &progress{
+		out:    out,
+		tty:    isTerminal(out),
+		name:   tf.FileName,
+		pieces: tf.PieceCount(),
+		task:   task,
+		cancel: func() {},
+		done:   make(chan struct{}),
+	}
+	if verbose {
+		close(p.done)
+		return p
+	}
+	log.SetOutput(io.Discard)
+	var events <-chan torrent.Event
+	events, p.cancel = task.Subscribe()
+	go p.loop(events)
+	return p
+}
+
+// stop 输出最后的状态，然后恢复日志，Download没有运行或者还没有返回时也可以调用
+func (p *progress) stop() {
+	p.cancel()
+	<-p.done
+	log.SetOutput(os.Stderr)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *progress) loop(events <-chan torrent.Event) {
+	defer close(p.done)
+	for e := range events {
+		switch e := e.(type) {
+		case torrent.AnnounceResult:
+			p.tracker = describeAnnounce(e)
+			p.render(p.task.Stats(), false)
+		case torrent.Stats:
+			p.render(e, false)
+		}
+	}
+	// Download已经返回
+	p.render(p.task.Stats(), true)
+}
+
+func describeAnnounce(r torrent.AnnounceResult) string {
+	swarm := ""
+	if r.V2 {
+		swarm = "v2 "
+	}
+	if r.Err != nil {
+		err := r.Err
+		// url.Error带着完整的请求地址，太长
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return fmt.Sprintf("%serror: %v", swarm, err)
+	}
+	ret := fmt.Sprintf("%sok, %d peers", swarm, r.Peers)
+	if r.Complete+r.Incomplete > 0 {
+		ret += fmt.Sprintf(" (%d seeders, %d leechers)", r.Complete, r.Incomplete)
+	}
+	if r.Warning != "" {
+		ret += ", warning: " + r.Warning
+	}
+	return ret
+}
+
+func (p *progress) render(s torrent.Stats, final bool) {
+	percent := 100.0
+	if s.BytesWanted > 0 {
+		percent = float64(s.BytesWanted-s.BytesLeft) / float64(s.BytesWanted) * 100
+	}
+	tracker := p.tracker
+	if tracker == "" {
+		tracker = "-"
+	}
+	if !p.tty {
+		if !final && time.Since(p.printed) < plainInterval {
+			return
+		}
+		p.printed = time.Now()
+		fmt.Fprintf(p.out, "%s: %.1f%% (%d/%d pieces), down %s/s, up %s/s, eta %s, %d peers (%d choked), tracker: %s\n",
+			p.name, percent, s.PiecesDone, s.Pieces, formatBytes(s.Rate), formatBytes(s.UploadRate), formatETA(s), s.Peers, s.Choked, tracker)
+		return
+	}
+	lines := []string{
+		p.name,
+		fmt.Sprintf("[%s] %5.1f%%  %d/%d pieces", p.bar(), percent, s.PiecesDone, s.Pieces),
+		fmt.Sprintf("down %s/s  up %s/s  eta %s  done %s of %s  peers %d (%d choked)",
+			formatBytes(s.Rate), formatBytes(s.UploadRate), formatETA(s), formatBytes(float64(s.BytesWanted-s.BytesLeft)), formatBytes(float64(s.BytesWanted)), s.Peers, s.Choked),
+		"tracker: " + tracker,
+	}
+	buf := new(bytes.Buffer)
+	// 光标移回上次输出的开头，逐行清除后重写
+	if p.lines > 0 {
+		fmt.Fprintf(buf, "\x1b[%dA", p.lines)
+	}
+	for _, l := range lines {
+		buf.WriteString("\x1b[2K" + l + "\n")
+	}
+	p.lines = len(lines)
+	_, _ = p.out.Write(buf.Bytes())
+}
+
+// bar 每一格代表一段piece，全部完成、部分完成和没有完成用不同的字符
+func (p *progress) bar() string {
+	field := p.task.Completed()
+	width := barWidth
+	if p.pieces < width {
+		width = p.pieces
+	}
+	var sb strings.Builder
+	for i := 0; i < width; i++ {
+		begin, end := i*p.pieces/width, (i+1)*p.pieces/width
+		done := 0
+		for idx := begin; idx < end; idx++ {
+			if field.HasPiece(idx) {
+				done++
+			}
+		}
+		switch {
+		case done == end-begin:
+			sb.WriteString("█")
+		case done > 0:
+			sb.WriteString("▒")
+		default:
+			sb.WriteString("░")
+		}
+	}
+	return sb.String()
+}
+
+func formatETA(s torrent.Stats) string {
+	if s.BytesLeft == 0 {
+		return "0s"
+	}
+	if s.Rate <= 0 {
+		return "-"
+	}
+	return time.Duration(float64(s.BytesLeft) / s.Rate * float64(time.Second)).Round(time.Second).String()
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"go-torrent/torrent"
+	"log"
+	"net/http"
+	"time"
+)
+
+// runServe 下载的同时通过http提供文件，下载完成后继续提供
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "listen address")
+	dir := fs.String("dir", ".", "download directory")
+	listen := fs.String("listen", ":6666", "address to accept peer connections on")
+	downLimit := fs.String("down-limit", "", "download rate limit of all torrents in bytes per second, K/M/G suffixes allowed")
+	upLimit := fs.String("up-limit", "", "upload rate limit of all torrents in bytes per second, K/M/G suffixes allowed; only protocol messages are sent until seeding is supported")
+	banFile := fs.String("ban-file", "", "file to keep ips banned for sending corrupt data")
+	blockFile := fs.String("blocklist", "", "ip blocklist in P2P or DAT format")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatalln("usage: go-torrent serve [-addr host:port] [-listen host:port] [-dir dir] [-down-limit 1M] [-up-limit 100K] [-ban-file bans.txt] [-blocklist list.p2p] <file.torrent>...")
+	}
+	cfg := torrent.ClientConfig{
+		ListenAddr:    *listen,
+		Dir:           *dir,
+		DownloadLimit: parseRate(*downLimit),
+		UploadLimit:   parseRate(*upLimit),
+	}
+	if err := serve(fs.Args(), *addr, cfg, *banFile, *blockFile); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// serve 出错时返回，保证停止已经添加的种子、关闭封禁列表等清理都能执行
+func serve(paths []string, addr string, cfg torrent.ClientConfig, banFile, blockFile string) error {
+	tfs := make([]*torrent.TorrentFile, len(paths))
+	for i, path := range paths {
+		tf, err := openTorrent(path)
+		if err != nil {
+			return err
+		}
+		tfs[i] = tf
+	}
+	bans, blocklist, err := loadBans(banFile, blockFile)
+	if err != nil {
+		return err
+	}
+	defer closeBans(bans)
+	cfg.Bans, cfg.Blocklist = bans, blocklist
+	// 多个种子共用一个监听端口、peer id和限速
+	cli, err := torrent.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+	// 停止所有种子，各自向tracker发送stopped
+	defer func() {
+		_ = cli.Close()
+	}()
+	srv := torrent.NewServer()
+	for i, tf := range tfs {
+		t, err := cli.Add(tf)
+		if err != nil {
+			return fmt.Errorf("add %s: %w", paths[i], err)
+		}
+		srv.Add(t.Task())
+		log.Printf("serving %s at http://%s/%s/\n", tf.FileName, addr, hex.EncodeToString(tf.InfoSHA[:]))
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	httpSrv := &http.Server{Addr: addr, Handler: srv}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpSrv.Shutdown(shutdown)
+	}()
+	if err = httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
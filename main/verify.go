@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"go-torrent/torrent"
+	"log"
+	"os"
+	"strings"
+)
+
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("dir", ".", "directory that contains the downloaded data")
+	workers := fs.Int("workers", 0, "number of hashing goroutines, 0 means one per CPU")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalln("usage: go-torrent verify [-dir path] [-workers n] <file.torrent>")
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tf, err := torrent.ParseFile(bufio.NewReader(file))
+	_ = file.Close()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	res, err := torrent.Verify(tf, *dir, *workers)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, f := range res.Files {
+		switch {
+		case f.Complete():
+			fmt.Printf("OK       %s\n", f.Path)
+		case !f.Exists:
+			fmt.Printf("MISSING  %s\n", f.Path)
+		default:
+			fmt.Printf("BAD      %s (%d missing, %d corrupt pieces)\n", f.Path, len(f.Missing), len(f.Corrupt))
+		}
+	}
+	fmt.Printf("%d/%d pieces complete, %d missing, %d corrupt\n", res.Count(torrent.PieceComplete),
+		len(res.Pieces), res.Count(torrent.PieceMissing), res.Count(torrent.PieceCorrupt))
+	if res.OK() {
+		return
+	}
+	var bad []string
+	for i, s := range res.Pieces {
+		if s == torrent.PieceCorrupt {
+			bad = append(bad, fmt.Sprint(i))
+		}
+	}
+	if len(bad) > 0 {
+		fmt.Printf("corrupt pieces: %s\n", strings.Join(bad, ","))
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,279 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxHashFails 一个ip发来的piece校验失败这么多次之后封禁
+const MaxHashFails = 3
+
+var errBanned = errors.New("torrent: peer banned")
+
+// peerTrust 一个ip发来的piece的校验结果
+type peerTrust struct {
+	good int
+	bad  int
+}
+
+// BanList 记录每个ip的校验结果，多次发来坏数据的ip被封禁，
+// 打开文件时封禁的ip追加写到文件里，下次启动仍然有效
+type BanList struct {
+	mu     sync.Mutex
+	trust  map[string]*peerTrust
+	banned map[string]bool
+	file   *os.File
+}
+
+func NewBanList() *BanList {
+	return &BanList{trust: make(map[string]*peerTrust), banned: make(map[string]bool)}
+}
+
+// OpenBanList 读取已有的封禁列表，之后封禁的ip追加到文件，每行一个ip，#开头是注释
+func OpenBanList(path string) (*BanList, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b := NewBanList()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("ban list %s: invalid ip %q", path, line)
+		}
+		b.banned[ip.String()] = true
+	}
+	if err = sc.Err(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	b.file = f
+	return b, nil
+}
+
+func (b *BanList) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// Ban 封禁ip，有文件时同时写入
+func (b *BanList) Ban(ip net.IP) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banLocked(ip.String())
+}
+
+func (b *BanList) banLocked(key string) error {
+	if b.banned[key] {
+		return nil
+	}
+	b.banned[key] = true
+	if b.file == nil {
+		return nil
+	}
+	_, err := b.file.WriteString(key + "\n")
+	return err
+}
+
+func (b *BanList) Banned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banned[ip.String()]
+}
+
+// Trust 这个ip发来的piece中通过和没有通过校验的个数
+func (b *BanList) Trust(ip net.IP) (good, bad int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if tr, ok := b.trust[ip.String()]; ok {
+		return tr.good, tr.bad
+	}
+	return 0, 0
+}
+
+// record 记录一次校验结果，返回这个ip是否被封禁
+func (b *BanList) record(ip net.IP, ok bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := ip.String()
+	tr, exist := b.trust[key]
+	if !exist {
+		tr = &peerTrust{}
+		b.trust[key] = tr
+	}
+	if ok {
+		tr.good++
+	} else if tr.bad++; tr.bad >= MaxHashFails {
+		_ = b.banLocked(key)
+	}
+	return b.banned[key]
+}
+
+// ipRange 包含两端
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// Blocklist 不连接也不接受连接的ip段
+type Blocklist struct {
+	ranges []ipRange // 按first排序，没有重叠
+}
+
+// LoadBlocklist 读取P2P格式(描述:起始ip-结束ip)或者DAT格式(起始ip - 结束ip , 级别 , 描述)的列表，
+// ip可以是ipv4或者ipv6，DAT格式级别大于127的段是允许的，会被忽略
+func LoadBlocklist(r io.Reader) (*Blocklist, error) {
+	var ranges []ipRange
+	sc := bufio.NewScanner(r)
+	num := 0
+	for sc.Scan() {
+		num++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rg, ok, err := parseBlockLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist line %d: %w", num, err)
+		}
+		if ok {
+			ranges = append(ranges, rg)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first, ranges[j].first) < 0
+	})
+	// 合并重叠的段
+	merged := ranges[:0]
+	for _, rg := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(rg.first, merged[n-1].last) <= 0 {
+			if bytes.Compare(rg.last, merged[n-1].last) > 0 {
+				merged[n-1].last = rg.last
+			}
+			continue
+		}
+		merged = append(merged, rg)
+	}
+	return &Blocklist{ranges: merged}, nil
+}
+
+// parseBlockLine ok为false表示这一行是DAT格式中允许的段
+func parseBlockLine(line string) (ipRange, bool, error) {
+	// DAT: 001.002.003.004 - 001.002.003.255 , 000 , description
+	if parts := strings.SplitN(line, ",", 3); len(parts) >= 2 {
+		if rg, err := parseBlockRange(parts[0]); err == nil {
+			level, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return ipRange{}, false, fmt.Errorf("invalid level %q", parts[1])
+			}
+			return rg, level <= 127, nil
+		}
+	}
+	// P2P: description:1.2.3.4-1.2.3.255，描述和ipv6里都可能有冒号，
+	// 从左往右找第一个之后能解析成ip段的冒号
+	for i := strings.Index(line, ":"); i >= 0; {
+		if rg, err := parseBlockRange(line[i+1:]); err == nil {
+			return rg, true, nil
+		}
+		next := strings.Index(line[i+1:], ":")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return ipRange{}, false, fmt.Errorf("invalid line %q", line)
+}
+
+func parseBlockRange(s string) (ipRange, error) {
+	ends := strings.SplitN(s, "-", 2)
+	if len(ends) != 2 {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	first, last := parseBlockIP(ends[0]), parseBlockIP(ends[1])
+	// 两端必须是同一种地址
+	if first == nil || last == nil || (first.To4() == nil) != (last.To4() == nil) || bytes.Compare(first, last) > 0 {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	return ipRange{first, last}, nil
+}
+
+// parseBlockIP DAT格式的ipv4每段补零到三位，比如001.002.003.004，net.ParseIP不接受，
+// 统一返回16字节的形式，ipv4和ipv6可以直接比较
+func parseBlockIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip.To16()
+}
+
+func (b *Blocklist) Len() int {
+	return len(b.ranges)
+}
+
+func (b *Blocklist) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// 第一个起始地址大于ip的段的前一个
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].first, ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip, b.ranges[i-1].last) <= 0
+}
+
+// blocked 封禁或者在blocklist里的ip
+func (t *TorrentTask) blocked(ip net.IP) bool {
+	return (t.Bans != nil && t.Bans.Banned(ip)) || (t.Blocklist != nil && t.Blocklist.Contains(ip))
+}
+
+// filterPeers 去掉被封禁的peer
+func (t *TorrentTask) filterPeers(peers []PeerInfo) []PeerInfo {
+	ret := make([]PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		if t.blocked(p.IP) {
+			log.Printf("drop peer %s: blocked\n", p.IP.String())
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadBlocklist(t *testing.T) {
+	list := `# comment
+Some org: with colon:1.2.3.0-1.2.3.255
+010.000.000.000 - 010.000.000.255 , 000 , dat, with comma
+010.000.000.128 - 010.000.001.010 , 100 , overlap
+192.168.000.000 - 192.168.255.255 , 200 , allowed
+v6 org: with colon:2001:db8::-2001:db8::ffff
+fd00:0000:0000:0000:0000:0000:0000:0000 - fd00:0000:0000:0000:ffff:ffff:ffff:ffff , 000 , dat v6
+`
+	b, err := LoadBlocklist(strings.NewReader(list))
+	assert.Equal(t, nil, err)
+	// 重叠的段合并，级别大于127的忽略
+	assert.Equal(t, 4, b.Len())
+	assert.True(t, b.Contains(net.ParseIP("1.2.3.4")))
+	assert.True(t, b.Contains(net.ParseIP("10.0.1.10")))
+	assert.False(t, b.Contains(net.ParseIP("10.0.1.11")))
+	assert.False(t, b.Contains(net.ParseIP("1.2.4.0")))
+	assert.False(t, b.Contains(net.ParseIP("192.168.1.1")))
+	assert.False(t, b.Contains(net.ParseIP("::1")))
+	assert.True(t, b.Contains(net.ParseIP("2001:db8::1")))
+	assert.False(t, b.Contains(net.ParseIP("2001:db8::1:0")))
+	assert.True(t, b.Contains(net.ParseIP("fd00::1234")))
+	assert.False(t, b.Contains(net.ParseIP("fd00:0:0:1::")))
+
+	_, err = LoadBlocklist(strings.NewReader("bad line\n"))
+	assert.NotEqual(t, nil, err)
+	// 两端一个ipv4一个ipv6
+	_, err = LoadBlocklist(strings.NewReader("mixed:1.2.3.4-2001:db8::1\n"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestBanList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.txt")
+	b, err := OpenBanList(path)
+	assert.Equal(t, nil, err)
+	ip := net.ParseIP("10.0.0.1")
+	assert.False(t, b.record(ip, true))
+	for i := 1; i < MaxHashFails; i++ {
+		assert.False(t, b.record(ip, false))
+	}
+	assert.True(t, b.record(ip, false))
+	good, bad := b.Trust(ip)
+	assert.Equal(t, 1, good)
+	assert.Equal(t, MaxHashFails, bad)
+	assert.Equal(t, nil, b.Ban(net.ParseIP("::2")))
+	assert.Equal(t, nil, b.Close())
+
+	// 重新打开后仍然封禁
+	b, err = OpenBanList(path)
+	assert.Equal(t, nil, err)
+	defer func() {
+		_ = b.Close()
+	}()
+	assert.True(t, b.Banned(ip))
+	assert.True(t, b.Banned(net.ParseIP("::2")))
+	assert.False(t, b.Banned(net.ParseIP("10.0.0.2")))
+}
+
+func TestBanCorruptPeer(t *testing.T) {
+	data := []byte("helloworld!0123456789")
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, data},
+	})))
+	// macOS和BSD默认只有127.0.0.1
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("127.0.0.2 is not available:", err)
+	}
+	_ = ln.Close()
+	var active, peak int64
+	bad := listenSeedOn(t, "127.0.0.2", tf.InfoSHA, 4, bytes.Repeat([]byte("x"), len(data)), &active, &peak)
+	good := listenSeed(t, tf.InfoSHA, 4, data, &active, &peak)
+	task := NewTask(tf, [IDLEN]byte{}, []PeerInfo{bad, good})
+	task.Dir = t.TempDir()
+	// 先连上发坏数据的peer
+	task.MaxConns = 1
+	events, cancel := task.Subscribe()
+	defer cancel()
+	assert.Equal(t, nil, Download(context.Background(), task))
+
+	banned := false
+	for e := range events {
+		if b, ok := e.(PeerBanned); ok {
+			assert.True(t, b.IP.Equal(bad.IP))
+			banned = true
+		}
+	}
+	assert.True(t, banned)
+	assert.True(t, task.Bans.Banned(bad.IP))
+	assert.False(t, task.Bans.Banned(good.IP))
+	_, fails := task.Bans.Trust(bad.IP)
+	assert.Equal(t, MaxHashFails, fails)
+	// 不再作为候选
+	task.conns.mu.Lock()
+	_, ok := task.conns.peers[bad.String()]
+	task.conns.mu.Unlock()
+	assert.False(t, ok)
+	assert.Equal(t, 0, len(task.filterPeers([]PeerInfo{bad})))
+}
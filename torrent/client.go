@@ -0,0 +1,339 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxConns Client所有种子加起来的最大连接数
+const DefaultMaxConns = 200
+
+// 停止时向tracker汇报最多等待的时间
+const stoppedTimeout = 5 * time.Second
+
+var (
+	ErrClientClosed  = errors.New("torrent: client closed")
+	ErrDuplicateTask = errors.New("torrent: torrent already added")
+)
+
+type ClientConfig struct {
+	ListenAddr string // 接受其他peer连接的地址，为空时是":6666"，不指定ip时同时接受ipv4和ipv6
+	Dir        string // 下载目录，为空时是当前目录
+	MaxConns   int    // 为0时是DefaultMaxConns
+	// 每个种子的最大连接数，种子自己设置了MaxConns时不生效，为0时是DefaultTorrentConns
+	MaxTorrentConns int
+
+	DownloadLimit int // 所有种子加起来的下载速度，字节每秒，0表示不限速
+	UploadLimit   int // 目前不做种，只限制发出的协议消息，见TorrentTask.SetUploadLimit
+
+	Bans      *BanList   // 所有种子共用，为空时Client自己创建一个不保存的
+	Blocklist *Blocklist // 不连接也不接受连接的ip段
+}
+
+// Client 同时下载多个种子，共用一个监听端口、peer id和连接数限制
+type Client struct {
+	PeerId   [IDLEN]byte
+	cfg      ClientConfig
+	listener net.Listener
+	slots    chan struct{}
+	down     *Limiter
+	up       *Limiter
+
+	mu       sync.Mutex
+	torrents map[[SHALEN]byte]*Torrent // v1和v2的info hash都能查到
+	closed   bool
+}
+
+// Torrent Client中的一个种子
+type Torrent struct {
+	tf   *TorrentFile
+	task *TorrentTask
+	done chan struct{}
+	err  error
+
+	mu     sync.Mutex
+	paused bool
+}
+
+// NewClient 开始监听，之后用Add添加种子
+func NewClient(cfg ClientConfig) (*Client, error) {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":6666"
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = DefaultMaxConns
+	}
+	if cfg.Bans == nil {
+		cfg.Bans = NewBanList()
+	}
+	peerId, err := newPeerId()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		PeerId:   peerId,
+		cfg:      cfg,
+		listener: ln,
+		slots:    make(chan struct{}, cfg.MaxConns),
+		down:     NewLimiter(cfg.DownloadLimit),
+		up:       NewLimiter(cfg.UploadLimit),
+		torrents: make(map[[SHALEN]byte]*Torrent),
+	}
+	go c.acceptLoop()
+	return c, nil
+}
+
+// newPeerId Azureus风格的客户端id，前缀之后是随机字节
+func newPeerId() ([IDLEN]byte, error) {
+	var id [IDLEN]byte
+	n := copy(id[:], "-GT0001-")
+	_, err := rand.Read(id[n:])
+	return id, err
+}
+
+// Port 实际监听的端口，ListenAddr的端口为0时由系统分配
+func (c *Client) Port() int {
+	return c.listener.Addr().(*net.TCPAddr).Port
+}
+
+// SetDownloadLimit 修改全局的下载限速，字节每秒，<=0不限速
+func (c *Client) SetDownloadLimit(rate int) {
+	c.down.SetRate(rate)
+}
+
+// SetUploadLimit 修改全局的上传限速，字节每秒，<=0不限速，见TorrentTask.SetUploadLimit
+func (c *Client) SetUploadLimit(rate int) {
+	c.up.SetRate(rate)
+}
+
+// Add 添加种子，向tracker汇报之后在后台下载
+func (c *Client) Add(tf *TorrentFile) (*Torrent, error) {
+	return c.AddTask(tf, NewTask(tf, c.PeerId, nil))
+}
+
+// AddTask 和Add一样，可以先设置task的优先级等字段，PeerId和连接数限制使用Client的，
+// 没有设置Dir时使用ClientConfig.Dir
+func (c *Client) AddTask(tf *TorrentFile, task *TorrentTask) (*Torrent, error) {
+	task.PeerId = c.PeerId
+	task.Tracker = tf
+	if task.Dir == "" {
+		task.Dir = c.cfg.Dir
+	}
+	task.slots = c.slots
+	task.port = c.Port()
+	task.sharedDown, task.sharedUp = c.down, c.up
+	if task.MaxConns == 0 {
+		task.MaxConns = c.cfg.MaxTorrentConns
+	}
+	if task.Bans == nil {
+		task.Bans = c.cfg.Bans
+	}
+	if task.Blocklist == nil {
+		task.Blocklist = c.cfg.Blocklist
+	}
+	t := &Torrent{tf: tf, task: task, done: make(chan struct{})}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	if _, ok := c.torrents[task.InfoSHA]; ok {
+		c.mu.Unlock()
+		return nil, ErrDuplicateTask
+	}
+	c.torrents[task.InfoSHA] = t
+	if task.isV2() {
+		c.torrents[task.InfoSHAV2] = t
+	}
+	c.mu.Unlock()
+
+	task.prepare()
+	go t.run()
+	return t, nil
+}
+
+func (t *Torrent) run() {
+	defer close(t.done)
+	// Remove时中断还没有返回的announce，得到的peer由Announce加入候选
+	t.task.Announce(t.task.ctx, t.tf, EventStarted)
+	// 下载期间定期汇报，结束时的stopped也在Download中
+	t.err = Download(context.Background(), t.task)
+	if t.err != nil && t.err != ErrStopped {
+		log.Printf("download %s failed: %v\n", t.task.FileName, t.err)
+	}
+}
+
+// Remove 停止并移除种子，已经下载的数据保留
+func (c *Client) Remove(infoSHA [SHALEN]byte) bool {
+	c.mu.Lock()
+	t, ok := c.torrents[infoSHA]
+	if ok {
+		delete(c.torrents, t.task.InfoSHA)
+		delete(c.torrents, t.task.InfoSHAV2)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	t.task.Stop()
+	<-t.done
+	return true
+}
+
+// Torrents 当前所有的种子
+func (c *Client) Torrents() []*Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make([]*Torrent, 0, len(c.torrents))
+	for hash, t := range c.torrents {
+		// hybrid种子有两个key
+		if hash == t.task.InfoSHA {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// Close 停止监听和所有的种子
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	err := c.listener.Close()
+	for _, t := range c.Torrents() {
+		c.Remove(t.task.InfoSHA)
+	}
+	return err
+}
+
+func (c *Client) acceptLoop() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			// 监听已经关闭
+			return
+		}
+		go c.handleConn(conn)
+	}
+}
+
+// handleConn 根据握手中的info hash把连接交给对应的种子
+func (c *Client) handleConn(conn net.Conn) {
+	t, pc, err := c.acceptPeer(conn)
+	if err != nil {
+		log.Printf("reject peer %s: %v\n", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	defer t.task.releaseIncoming()
+	log.Printf("accept peer: %s\n", pc.peer.IP.String())
+	_ = t.task.connRoutine(pc)
+}
+
+func (c *Client) acceptPeer(conn net.Conn) (*Torrent, *PeerConn, error) {
+	if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		return nil, nil, err
+	}
+	req, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	t, ok := c.torrents[req.InfoSHA]
+	c.mu.Unlock()
+	if !ok {
+		return nil, nil, errors.New("unknown info hash")
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && t.task.blocked(addr.IP) {
+		return nil, nil, errBanned
+	}
+	// 连接数已满时直接拒绝，不排队
+	if err = t.task.acquireIncoming(); err != nil {
+		return nil, nil, err
+	}
+	res := NewHandshakeMsg(req.InfoSHA, c.PeerId)
+	if t.task.isV2() {
+		res.SetV2()
+	}
+	if _, err = WriteHandshake(conn, res); err != nil {
+		t.task.releaseIncoming()
+		return nil, nil, err
+	}
+	var peer PeerInfo
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer = PeerInfo{IP: addr.IP, Port: uint16(addr.Port), V2: req.InfoSHA == t.task.InfoSHAV2}
+	}
+	pc := &PeerConn{
+		Conn:    conn,
+		Choked:  true,
+		peer:    peer,
+		peerId:  c.PeerId,
+		infoSHA: req.InfoSHA,
+	}
+	if err = fillBitfield(pc); err != nil {
+		t.task.releaseIncoming()
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return t, pc, nil
+}
+
+// Task 种子对应的下载任务，可以用来创建Reader或者修改文件优先级
+func (t *Torrent) Task() *TorrentTask {
+	return t.task
+}
+
+func (t *Torrent) InfoSHA() [SHALEN]byte {
+	return t.task.InfoSHA
+}
+
+func (t *Torrent) Name() string {
+	return t.task.FileName
+}
+
+// Pause 不再分配新的piece，正在下载的piece会继续完成
+func (t *Torrent) Pause() {
+	t.setPaused(true)
+}
+
+func (t *Torrent) Resume() {
+	t.setPaused(false)
+}
+
+func (t *Torrent) setPaused(paused bool) {
+	t.mu.Lock()
+	t.paused = paused
+	t.mu.Unlock()
+	t.task.pk.setPaused(paused)
+}
+
+func (t *Torrent) Paused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+// Done 下载完成或者停止时关闭
+func (t *Torrent) Done() <-chan struct{} {
+	return t.done
+}
+
+// Subscribe 订阅这个种子的下载事件，见TorrentTask.Subscribe
+func (t *Torrent) Subscribe() (<-chan Event, func()) {
+	return t.task.Subscribe()
+}
+
+// Wait 等待下载结束，返回Download的结果
+func (t *Torrent) Wait() error {
+	<-t.done
+	return t.err
+}
@@ -0,0 +1,193 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seedTo 模拟拥有全部数据的peer主动连接client并上传
+func seedTo(t *testing.T, port int, infoSHA [SHALEN]byte, pieceLen int, data []byte) {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, err = WriteHandshake(conn, NewHandshakeMsg(infoSHA, [IDLEN]byte{'s'})); err != nil {
+		return
+	}
+	if _, err = ReadHandshake(conn); err != nil {
+		return
+	}
+	seedConn(conn, pieceLen, data)
+}
+
+// seedConn 握手之后发送完整的bitfield，然后回应所有请求
+func seedConn(conn net.Conn, pieceLen int, data []byte) {
+	pc := &PeerConn{Conn: conn}
+	count := (len(data) + pieceLen - 1) / pieceLen
+	field := make(Bitfield, (count+7)/8)
+	for i := 0; i < count; i++ {
+		field.SetPiece(i)
+	}
+	_, _ = pc.WriteMsg(&PeerMsg{MsgBitfield, field})
+	_, _ = pc.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	for {
+		msg, err := pc.ReadMsg()
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.Id != MsgRequest {
+			continue
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+		offset := index*pieceLen + begin
+		payload := make([]byte, 8, 8+length)
+		copy(payload, msg.Payload[:8])
+		payload = append(payload, data[offset:offset+length]...)
+		if _, err = pc.WriteMsg(&PeerMsg{MsgPiece, payload}); err != nil {
+			return
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"b.txt"}, []byte("world!")},
+	}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, files)))
+	tf.Announce = ""
+	cli, err := NewClient(ClientConfig{ListenAddr: "127.0.0.1:0", Dir: t.TempDir()})
+	assert.Equal(t, nil, err)
+	defer func() {
+		_ = cli.Close()
+	}()
+	assert.Equal(t, "-GT0001-", string(cli.PeerId[:8]))
+
+	tr, err := cli.Add(tf)
+	assert.Equal(t, nil, err)
+	_, err = cli.Add(tf)
+	assert.Equal(t, ErrDuplicateTask, err)
+	assert.Equal(t, 1, len(cli.Torrents()))
+
+	// 暂停时连进来的peer不会分配到piece
+	tr.Pause()
+	assert.True(t, tr.Paused())
+	go seedTo(t, cli.Port(), tf.InfoSHA, 4, []byte("helloworld!"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, tr.Task().pieceCount(), tr.Task().pk.remaining())
+
+	tr.Resume()
+	select {
+	case <-tr.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not finish")
+	}
+	assert.Equal(t, nil, tr.Wait())
+	data, err := os.ReadFile(filepath.Join(cli.cfg.Dir, "bundle", "b.txt"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "world!", string(data))
+	assert.True(t, cli.Remove(tf.InfoSHA))
+	assert.False(t, cli.Remove(tf.InfoSHA))
+}
+
+func TestClientRemove(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	tf.Announce = ""
+	cli, err := NewClient(ClientConfig{ListenAddr: "127.0.0.1:0", Dir: t.TempDir()})
+	assert.Equal(t, nil, err)
+	tr, _ := cli.Add(tf)
+
+	// 不认识的info hash握手后直接断开
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(cli.Port())))
+	assert.Equal(t, nil, err)
+	_, _ = WriteHandshake(conn, NewHandshakeMsg([SHALEN]byte{1}, [IDLEN]byte{}))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ReadHandshake(conn)
+	assert.NotEqual(t, nil, err)
+	_ = conn.Close()
+
+	// 没有peer时一直等待，移除后返回ErrStopped
+	assert.True(t, cli.Remove(tf.InfoSHA))
+	assert.Equal(t, ErrStopped, tr.Wait())
+	assert.Equal(t, nil, cli.Close())
+	_, err = cli.Add(tf)
+	assert.Equal(t, ErrClientClosed, err)
+}
+
+func TestClientReannounce(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	var mu sync.Mutex
+	var events, ids []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		ids = append(ids, r.URL.Query().Get("trackerid"))
+		mu.Unlock()
+		_, _ = w.Write([]byte("d8:intervali1e5:peers0:10:tracker id2:t1e"))
+	}))
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+	dir := t.TempDir()
+	cli, err := NewClient(ClientConfig{ListenAddr: "127.0.0.1:0", Dir: dir})
+	assert.Equal(t, nil, err)
+	defer func() {
+		_ = cli.Close()
+	}()
+	tr, err := cli.AddTask(tf, NewTask(tf, [IDLEN]byte{}, nil))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, dir, tr.Task().Dir)
+	sub, cancel := tr.Subscribe()
+	defer cancel()
+
+	// 按interval重新汇报
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) >= 2
+	}, 3*time.Second, 50*time.Millisecond)
+	assert.True(t, cli.Remove(tf.InfoSHA))
+	// stopped的结果在事件关闭之前发出
+	stopped := false
+	for e := range sub {
+		if r, ok := e.(AnnounceResult); ok && r.Event == EventStopped {
+			stopped = true
+		}
+	}
+	assert.True(t, stopped)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{EventStarted, ""}, events[:2])
+	assert.Equal(t, EventStopped, events[len(events)-1])
+	assert.Equal(t, "", ids[0])
+	assert.Equal(t, "t1", ids[len(ids)-1])
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	task := &TorrentTask{}
+	assert.Equal(t, defaultAnnounceInterval, task.announceInterval())
+	task.interval, task.minInterval = 60, 120
+	assert.Equal(t, 2*time.Minute, task.announceInterval())
+	task.announceFailed = true
+	task.minInterval = 0
+	assert.Equal(t, announceRetry, task.announceInterval())
+}
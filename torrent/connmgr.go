@@ -0,0 +1,278 @@
+package torrent
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTorrentConns 每个种子的最大连接数，包括对方连过来的
+	DefaultTorrentConns = 50
+	// DefaultMaxDialing 每个种子同时进行的拨号数
+	DefaultMaxDialing = 8
+)
+
+const (
+	minBackoff = 10 * time.Second
+	maxBackoff = 5 * time.Minute
+	// 连续失败这么多次之后不再尝试这个peer
+	maxPeerFails = 5
+	// 没有事件时也定期检查一次，比如优先级修改后又有了需要下载的piece
+	managerTick = 5 * time.Second
+	// 全局连接数满了之后重试的间隔，名额由其他种子释放，没有通知
+	slotRetry = time.Second
+)
+
+// ErrTooManyConns 全局或者这个种子的连接数已满
+var ErrTooManyConns = errors.New("torrent: too many connections")
+
+type peerState uint8
+
+const (
+	peerIdle peerState = iota
+	peerDialing
+	peerConnected
+)
+
+type candidate struct {
+	peer    PeerInfo
+	state   peerState
+	fails   int       // 连续失败的次数
+	nextTry time.Time // 在这之前不再连接
+}
+
+// connManager 管理一个种子的连接：从候选peer中按顺序拨号，限制连接数和同时拨号数，
+// 失败的peer按指数退避之后重试，连接断开后从候选中补充
+type connManager struct {
+	t       *TorrentTask
+	mu      sync.Mutex
+	peers   map[string]*candidate
+	order   []string // 加入的顺序，先加入的先连接
+	conns   int      // 已经建立的连接
+	dialing int
+	wake    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newConnManager(t *TorrentTask) *connManager {
+	return &connManager{
+		t:     t,
+		peers: make(map[string]*candidate),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// backoff 第fails次失败之后等待的时间
+func backoff(fails int) time.Duration {
+	d := minBackoff
+	for i := 1; i < fails && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+func (m *connManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// add 加入候选peer，已经有的忽略
+func (m *connManager) add(peers []PeerInfo) {
+	m.mu.Lock()
+	for _, p := range peers {
+		key := p.String()
+		if _, ok := m.peers[key]; ok {
+			continue
+		}
+		m.peers[key] = &candidate{peer: p}
+		m.order = append(m.order, key)
+	}
+	m.mu.Unlock()
+	m.notify()
+}
+
+func (m *connManager) maxConns() int {
+	if m.t.MaxConns > 0 {
+		return m.t.MaxConns
+	}
+	return DefaultTorrentConns
+}
+
+func (m *connManager) maxDialing() int {
+	if m.t.MaxDialing > 0 {
+		return m.t.MaxDialing
+	}
+	return DefaultMaxDialing
+}
+
+// run 直到种子停止，返回前等待所有连接结束
+func (m *connManager) run() {
+	defer m.wg.Wait()
+	for {
+		timer := time.NewTimer(m.dialMore(time.Now()))
+		select {
+		case <-m.wake:
+		case <-timer.C:
+		case <-m.t.ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// dialMore 在限制内尽量多拨号，返回下一次需要检查的时间间隔
+func (m *connManager) dialMore(now time.Time) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if m.conns+m.dialing >= m.maxConns() || m.dialing >= m.maxDialing() || m.t.pk.remaining() == 0 {
+			return managerTick
+		}
+		c, wait := m.pick(now)
+		if c == nil {
+			return wait
+		}
+		if !m.t.tryAcquire() {
+			return slotRetry
+		}
+		c.state = peerDialing
+		m.dialing++
+		m.wg.Add(1)
+		go m.dial(c)
+	}
+}
+
+// pick 第一个可以连接的候选，没有时返回最早可以重试的等待时间
+func (m *connManager) pick(now time.Time) (*candidate, time.Duration) {
+	wait := managerTick
+	for i := 0; i < len(m.order); i++ {
+		c := m.peers[m.order[i]]
+		if c.state != peerIdle {
+			continue
+		}
+		// 加入之后才被封禁的
+		if m.t.blocked(c.peer.IP) {
+			m.remove(m.order[i])
+			i--
+			continue
+		}
+		if !c.nextTry.After(now) {
+			return c, 0
+		}
+		if d := c.nextTry.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+func (m *connManager) dial(c *candidate) {
+	defer m.wg.Done()
+	defer m.t.release()
+	conn, err := dialPeer(m.t.ctx, c.peer, m.t.swarmHash(c.peer), m.t.PeerId, m.t.isV2())
+	if err != nil {
+		m.finish(c, peerDialing, err)
+		return
+	}
+	m.mu.Lock()
+	m.dialing--
+	m.conns++
+	c.state = peerConnected
+	m.mu.Unlock()
+	err = m.t.connRoutine(conn)
+	m.finish(c, peerConnected, err)
+}
+
+// finish 拨号失败或者连接断开，出错时退避，正常断开(没有需要它下载的piece)也隔一段时间再连
+func (m *connManager) finish(c *candidate, from peerState, err error) {
+	m.mu.Lock()
+	if from == peerDialing {
+		m.dialing--
+	} else {
+		m.conns--
+	}
+	c.state = peerIdle
+	if err != nil {
+		c.fails++
+		c.nextTry = time.Now().Add(backoff(c.fails))
+	} else {
+		c.fails = 0
+		c.nextTry = time.Now().Add(minBackoff)
+	}
+	if c.fails >= maxPeerFails || err == errBanned {
+		m.remove(c.peer.String())
+	}
+	m.mu.Unlock()
+	m.notify()
+}
+
+func (m *connManager) remove(key string) {
+	delete(m.peers, key)
+	for i, k := range m.order {
+		if k == key {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// acceptIncoming 对方连过来时占用一个连接，满了返回false
+func (m *connManager) acceptIncoming() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns+m.dialing >= m.maxConns() {
+		return false
+	}
+	m.conns++
+	return true
+}
+
+func (m *connManager) incomingDone() {
+	m.mu.Lock()
+	m.conns--
+	m.mu.Unlock()
+	m.notify()
+}
+
+// acquireIncoming 不是自己拨号的连接占用全局和这个种子的名额，满了返回ErrTooManyConns
+func (t *TorrentTask) acquireIncoming() error {
+	if !t.tryAcquire() {
+		return ErrTooManyConns
+	}
+	if !t.conns.acceptIncoming() {
+		t.release()
+		return ErrTooManyConns
+	}
+	return nil
+}
+
+func (t *TorrentTask) releaseIncoming() {
+	t.conns.incomingDone()
+	t.release()
+}
+
+// tryAcquire 占用一个全局的连接名额，满了返回false
+func (t *TorrentTask) tryAcquire() bool {
+	if t.slots == nil {
+		return true
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *TorrentTask) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
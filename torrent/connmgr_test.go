@@ -0,0 +1,145 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenSeed 等待连接的peer，拥有全部数据，active和peak记录同时存在的连接数
+func listenSeed(t *testing.T, infoSHA [SHALEN]byte, pieceLen int, data []byte, active, peak *int64) PeerInfo {
+	return listenSeedOn(t, "127.0.0.1", infoSHA, pieceLen, data, active, peak)
+}
+
+// listenSeedOn 在指定的ip上监听，用来区分不同的peer
+func listenSeedOn(t *testing.T, host string, infoSHA [SHALEN]byte, pieceLen int, data []byte, active, peak *int64) PeerInfo {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	assert.Equal(t, nil, err)
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				if _, err := ReadHandshake(conn); err != nil {
+					return
+				}
+				if _, err := WriteHandshake(conn, NewHandshakeMsg(infoSHA, [IDLEN]byte{'s'})); err != nil {
+					return
+				}
+				n := atomic.AddInt64(active, 1)
+				defer atomic.AddInt64(active, -1)
+				for p := atomic.LoadInt64(peak); n > p && !atomic.CompareAndSwapInt64(peak, p, n); p = atomic.LoadInt64(peak) {
+				}
+				seedConn(conn, pieceLen, data)
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return PeerInfo{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// refusedPeer 没有在监听的地址
+func refusedPeer(t *testing.T) PeerInfo {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	_ = ln.Close()
+	return PeerInfo{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, minBackoff, backoff(1))
+	assert.Equal(t, 2*minBackoff, backoff(2))
+	assert.Equal(t, maxBackoff, backoff(6))
+	assert.Equal(t, maxBackoff, backoff(100))
+}
+
+func TestConnManager(t *testing.T) {
+	data := []byte("helloworld!0123456789")
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, data},
+	})))
+	var active, peak int64
+	refused := refusedPeer(t)
+	task := NewTask(tf, [IDLEN]byte{}, []PeerInfo{
+		refused,
+		listenSeed(t, tf.InfoSHA, 4, data, &active, &peak),
+		listenSeed(t, tf.InfoSHA, 4, data, &active, &peak),
+	})
+	task.Dir = t.TempDir()
+	task.MaxConns = 1
+	task.MaxDialing = 1
+	assert.Equal(t, nil, Download(context.Background(), task))
+	// 同一时间只连接一个peer
+	assert.Equal(t, int64(1), atomic.LoadInt64(&peak))
+
+	// 连不上的peer要等退避之后再试
+	m := task.conns
+	m.mu.Lock()
+	c := m.peers[refused.String()]
+	assert.Equal(t, 1, c.fails)
+	assert.True(t, c.nextTry.After(time.Now()))
+	m.mu.Unlock()
+}
+
+func TestConnManagerPick(t *testing.T) {
+	m := newConnManager(&TorrentTask{})
+	a, b := refusedPeer(t), refusedPeer(t)
+	m.add([]PeerInfo{a, b, a})
+	assert.Equal(t, 2, len(m.order))
+	now := time.Now()
+	m.peers[a.String()].nextTry = now.Add(time.Second)
+	c, _ := m.pick(now)
+	assert.Equal(t, b.String(), c.peer.String())
+	// 都在退避时返回最早可以重试的时间
+	m.peers[b.String()].nextTry = now.Add(3 * time.Second)
+	c, wait := m.pick(now)
+	assert.True(t, c == nil)
+	assert.Equal(t, time.Second, wait)
+	// 失败太多次的peer被移除
+	m.peers[a.String()].state = peerDialing
+	m.dialing = 1
+	m.peers[a.String()].fails = maxPeerFails - 1
+	m.finish(m.peers[a.String()], peerDialing, net.ErrClosed)
+	assert.Equal(t, []string{b.String()}, m.order)
+}
+
+func TestAddConnLimit(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.MaxConns = 1
+	defer task.Stop()
+	pipe := func() *PeerConn {
+		a, b := net.Pipe()
+		t.Cleanup(func() {
+			_ = b.Close()
+		})
+		return &PeerConn{Conn: a, Choked: true}
+	}
+	// 对端不读，连接一直占着名额直到停止
+	assert.Equal(t, nil, task.AddConn(pipe()))
+	assert.Equal(t, ErrTooManyConns, task.AddConn(pipe()))
+
+	// 全局名额满了也不能加入
+	task = NewTask(tf, [IDLEN]byte{}, nil)
+	task.slots = make(chan struct{}, 1)
+	task.slots <- struct{}{}
+	assert.Equal(t, ErrTooManyConns, task.AddConn(pipe()))
+	task.conns.mu.Lock()
+	assert.Equal(t, 0, task.conns.conns)
+	task.conns.mu.Unlock()
+}
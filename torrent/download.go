@@ -1,10 +1,12 @@
 package torrent
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"context"
+	"errors"
 	"log"
-	"os"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,12 +18,146 @@ type TorrentTask struct {
 	FileLen  int          // 文件长度
 	PieceLen int
 	PieceSHA [][SHALEN]byte
+	Private  bool // BEP 27，只能从tracker获取peer，AddPeers会拒绝
+
+	Files       []FileInfo    // 纯v2种子按文件切分piece时使用
+	PieceSHA256 []PieceHashV2 // v2的piece哈希，hybrid种子和PieceSHA一起校验
+	InfoSHAV2   [SHALEN]byte  // 截断的v2 info hash，和v2 swarm中的peer握手时使用
+	WebSeeds    []string      // BEP 19，当作拥有全部piece的peer
+
+	Dir        string     // 下载目录，为空时是当前目录
+	Priorities []Priority // 每个文件的优先级，下标和Files一致，为空时全部下载
+	Sequential bool       // 相同优先级的piece按顺序下载，便于边下边用
+	MaxConns   int        // 最大连接数，为0时是DefaultTorrentConns
+	MaxDialing int        // 同时拨号数，为0时是DefaultMaxDialing
+	Bans       *BanList   // 多次发来坏数据的ip，可以多个种子共用，为空时只在这个任务内有效
+	Blocklist  *Blocklist // 不连接的ip段
+	// 不为空时Download期间按tracker给的间隔重新汇报，得到的peer加入候选，结束时汇报stopped
+	Tracker *TorrentFile
+
+	once     sync.Once
+	mu       sync.Mutex // 保护Priorities
+	store    *fileStorage
+	pk       *picker
+	results  chan *pieceResult // 校验过的piece交给Download写入
+	ctx      context.Context   // Stop时取消，所有连接和请求都跟着结束
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	slots    chan struct{} // 多个种子共享的连接数限制，为空时不限制
+	port     int           // 汇报给tracker的监听端口，为0时是PeerPort
+	events   *eventHub
+	stats    *taskStats
+	conns    *connManager
+	failMu   sync.Mutex
+	failed   map[int][]failedPiece // v2 piece校验失败时的数据，之后通过时用来找出坏块
+
+	announceMu     sync.Mutex
+	trackerIds     map[[SHALEN]byte]string // 每个swarm的tracker id
+	interval       int                     // 上一次成功汇报时tracker给的间隔，秒
+	minInterval    int
+	announceFailed bool // 上一次汇报失败
+
+	downLimit  *Limiter // 这个种子的限速
+	upLimit    *Limiter
+	sharedDown *Limiter // Client的全局限速，为空时没有
+	sharedUp   *Limiter
+}
+
+// prepare 第一次使用时创建存储和picker，Reader可以在Download之前创建
+func (t *TorrentTask) prepare() {
+	t.once.Do(func() {
+		t.store = newFileStorage(t.dir(), t.files(), true)
+		// 和跳过的文件共用的piece只写需要的那部分
+		t.store.skip = t.skipped()
+		t.pk = newPicker(t.piecePriorities())
+		t.pk.sequential = t.Sequential
+		// 长度保持为1就好，即无缓存
+		t.results = make(chan *pieceResult)
+		t.ctx, t.cancel = context.WithCancel(context.Background())
+		t.events = newEventHub()
+		t.stats = &taskStats{}
+		t.conns = newConnManager(t)
+		if t.Bans == nil {
+			t.Bans = NewBanList()
+		}
+		t.downLimit = NewLimiter(0)
+		t.upLimit = NewLimiter(0)
+	})
+}
+
+// Stop 停止下载，正在运行的Download返回ErrStopped，停止后不能再启动
+func (t *TorrentTask) Stop() {
+	t.prepare()
+	t.stopOnce.Do(func() {
+		t.cancel()
+		t.pk.close()
+	})
+}
+
+// deliver 把校验过的piece交给Download，已经停止时返回false
+func (t *TorrentTask) deliver(res *pieceResult) bool {
+	select {
+	case t.results <- res:
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
+
+// NewTask 根据种子文件生成下载任务
+func NewTask(tf *TorrentFile, peerId [IDLEN]byte, peers []PeerInfo) *TorrentTask {
+	return &TorrentTask{
+		PeerId:   peerId,
+		PeerList: peers,
+		InfoSHA:  tf.InfoSHA,
+		FileName: tf.FileName,
+		FileLen:  tf.FileLen,
+		PieceLen: tf.PieceLen,
+		PieceSHA: tf.PieceSHA,
+		Private:  tf.Private,
+
+		Files:       tf.Files,
+		PieceSHA256: tf.PieceSHA256,
+		InfoSHAV2:   tf.InfoSHAV2(),
+		WebSeeds:    tf.URLList,
+	}
+}
+
+// isV2 支持v2协议，握手时设置对应的保留位
+func (t *TorrentTask) isV2() bool {
+	return t.InfoSHAV2 != [SHALEN]byte{}
+}
+
+// swarmHash hybrid种子对v2 swarm中的peer使用v2的info hash
+func (t *TorrentTask) swarmHash(peer PeerInfo) [SHALEN]byte {
+	if peer.V2 && t.isV2() {
+		return t.InfoSHAV2
+	}
+	return t.InfoSHA
+}
+
+func (t *TorrentTask) pieceCount() int {
+	return pieceCount(t.PieceSHA, t.PieceSHA256)
+}
+
+// files 没有文件列表时当作单文件
+func (t *TorrentTask) files() []FileInfo {
+	if len(t.Files) == 0 {
+		return []FileInfo{{Path: []string{t.FileName}, Length: t.FileLen}}
+	}
+	return t.Files
+}
+
+func (t *TorrentTask) dir() string {
+	if t.Dir == "" {
+		return "."
+	}
+	return t.Dir
 }
 
 // 拆解后的每一个piece的task
 type pieceTask struct {
 	index  int // 序号
-	sha    [SHALEN]byte
 	length int // 长度，但如果是最后一篇可能会短一些
 }
 
@@ -48,9 +184,9 @@ func (s *taskState) handleMsg() error {
 	switch msg.Id {
 	case MsgChoke:
 		// peer不愿上传，该流程的piece放弃
-		s.conn.Choked = true
+		s.conn.setChoked(true)
 	case MsgUnchoke:
-		s.conn.Choked = false
+		s.conn.setChoked(false)
 	case MsgHave:
 		index, err := GetHaveIndex(msg)
 		if err != nil {
@@ -71,12 +207,10 @@ func (s *taskState) handleMsg() error {
 
 // getPieceBounds 切分下载的长度，指定开始和结束位置
 func (t *TorrentTask) getPieceBounds(idx int) (begin, end int) {
-	begin = idx * t.PieceLen
-	end = begin + t.FileLen
-	if end > t.FileLen {
-		end = t.FileLen
+	if len(t.PieceSHA) == 0 && len(t.PieceSHA256) > 0 {
+		return alignedBounds(t.PieceLen, t.Files, idx)
 	}
-	return begin, end
+	return pieceBounds(t.PieceLen, t.FileLen, idx)
 }
 
 // 放到channel，做sha的校验，校验成功就放到最后的data
@@ -90,91 +224,270 @@ const (
 	MaxBacklog = 5
 )
 
-func Download(task *TorrentTask) error {
+// Download 按优先级从peer和web seed下载需要的piece，校验后写到Dir下
+// ctx取消或者Stop时关闭所有连接，等待goroutine退出并把数据刷到磁盘后返回
+func Download(ctx context.Context, task *TorrentTask) error {
 	log.Printf("start downing %s\n", task.FileName)
-	taskCh := make(chan *pieceTask, len(task.PieceSHA))
-	defer close(taskCh)
-	// 长度保持为1就好，即无缓存
-	resultCh := make(chan *pieceResult)
-	defer close(resultCh)
-	for idx, sha := range task.PieceSHA {
-		// 拆分成小的pieceTask
-		begin, end := task.getPieceBounds(idx)
-		// 虽然分片长度固定，但最后一个可能会比较短
-		taskCh <- &pieceTask{idx, sha, end - begin}
-	}
-	for _, peer := range task.PeerList {
-		go task.peerRoutine(peer, taskCh, resultCh)
-	}
-	// 存下载数据，按道理是应该存于io文件，但是toy项目就存内存吧
-	buf := make([]byte, task.FileLen)
-	count := 0
-	for count < len(task.PieceSHA) {
-		res := <-resultCh
-		begin, end := task.getPieceBounds(res.index)
-		copy(buf[begin:end], res.data)
-		count++
-		percent := float64(count) / float64(len(task.PieceSHA)) * 100
+	task.prepare()
+	store, pk := task.store, task.pk
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			task.Stop()
+		case <-finished:
+		}
+	}()
+	var wg sync.WaitGroup
+	defer func() {
+		close(finished)
+		// 下载完成后也要停止，让还在等待的peer退出
+		task.Stop()
+		wg.Wait()
+		_ = store.Close()
+		task.events.publish(task.Stats())
+		task.events.close()
+	}()
+	task.stats.mu.Lock()
+	task.stats.start = time.Now()
+	task.stats.mu.Unlock()
+	task.stats.sample(time.Now())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		task.statsRoutine(finished)
+	}()
+	task.conns.add(task.filterPeers(task.PeerList))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		task.conns.run()
+	}()
+	if task.Tracker != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task.announceRoutine(task.Tracker)
+		}()
+	}
+	for _, u := range task.WebSeeds {
+		ws, err := newWebSeed(u, task.files())
+		if err != nil {
+			log.Printf("skip web seed: %v\n", err)
+			continue
+		}
+		ws.ctx = task.ctx
+		ws.down = task.limiters(task.downLimit, task.sharedDown)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task.webSeedRoutine(ws)
+		}()
+	}
+	// 运行中可能修改优先级，需要的piece数会变化
+	for pk.remaining() > 0 {
+		var res *pieceResult
+		select {
+		case res = <-task.results:
+		case <-pk.emptied:
+			// 剩下的文件都被跳过了，回到循环条件检查
+			continue
+		case <-task.ctx.Done():
+			if err := store.Sync(); err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return ErrStopped
+		}
+		begin, _ := task.getPieceBounds(res.index)
+		if _, err := store.WriteAt(res.data, int64(begin)); err != nil {
+			log.Println("fail to write data")
+			return err
+		}
+		pk.finish(res.index)
+		wanted := pk.wanted()
+		percent := float64(wanted-pk.remaining()) / float64(wanted) * 100
 		log.Printf("downloading, progress: (%0.2f%%)\n", percent)
 	}
-	file, err := os.Create(task.FileName)
-	if err != nil {
-		log.Println("fail to create file: " + task.FileName)
+	// 空文件不属于任何piece，单独创建
+	for i, f := range task.files() {
+		if f.Length == 0 && !store.skipped(i) {
+			if _, err := store.open(i); err != nil {
+				return err
+			}
+		}
+	}
+	if err := store.Sync(); err != nil {
 		return err
 	}
-	_, err = file.Write(buf)
-	if err != nil {
-		log.Println("fail to write data")
+	task.events.publish(DownloadComplete{})
+	return nil
+}
+
+// AddConn 使用已经完成握手的连接下载，比如对方主动连过来的peer，
+// 和拨号的连接一样占用连接数，满了或者ip被封禁时关闭conn并返回错误
+func (t *TorrentTask) AddConn(conn *PeerConn) error {
+	t.prepare()
+	if t.blocked(conn.peer.IP) {
+		_ = conn.Close()
+		return errBanned
+	}
+	if err := t.acquireIncoming(); err != nil {
+		_ = conn.Close()
 		return err
 	}
+	go func() {
+		defer t.releaseIncoming()
+		_ = t.connRoutine(conn)
+	}()
 	return nil
 }
 
-func (t *TorrentTask) peerRoutine(peer PeerInfo, taskCh chan *pieceTask, resultCh chan *pieceResult) {
-	// 建立连接
-	conn, err := NewConn(peer, t.InfoSHA, t.PeerId)
-	if err != nil {
-		log.Printf("failed to connect peer: %s\n", peer.IP.String())
-		return
+// ErrPrivate 私有种子只能使用tracker给的peer
+var ErrPrivate = errors.New("torrent: private torrent only accepts peers from the tracker")
+
+// AddPeers 加入从tracker以外得到的候选peer，比如手动指定或者以后的PEX、DHT，连接数没满时会去连接，
+// 私有种子返回ErrPrivate。tracker给的peer由Announce加入
+func (t *TorrentTask) AddPeers(peers []PeerInfo) error {
+	if t.Private {
+		return ErrPrivate
 	}
+	t.prepare()
+	t.conns.add(t.filterPeers(peers))
+	return nil
+}
+
+// connRoutine 从picker取这个peer拥有的piece下载，直到全部完成、出错或者停止，
+// 返回的错误用来决定多久之后重新连接
+func (t *TorrentTask) connRoutine(conn *PeerConn) error {
+	conn.Conn = t.limitConn(conn.Conn)
+	// 停止时关闭连接，阻塞在读写上的下载立即返回
+	defer watchConn(t.ctx, conn)()
 	defer func() {
 		_ = conn.Close()
 	}()
-	log.Printf("complete handshake with peer: %s\n", peer.IP.String())
+	atomic.AddInt64(&t.stats.peers, 1)
+	if conn.Choked {
+		atomic.AddInt64(&t.stats.choked, 1)
+	}
+	conn.choked = &t.stats.choked
+	t.events.publish(PeerConnected{Peer: conn.peer})
+	err := t.serveConn(conn)
+	atomic.AddInt64(&t.stats.peers, -1)
+	if conn.Choked {
+		atomic.AddInt64(&t.stats.choked, -1)
+	}
+	t.events.publish(PeerDisconnected{Peer: conn.peer, Err: err})
+	return err
+}
+
+func (t *TorrentTask) serveConn(conn *PeerConn) error {
 	// 写入信息
-	if _, err = conn.WriteMsg(&PeerMsg{MsgInterested, make([]byte, 0)}); err != nil {
+	if _, err := conn.WriteMsg(&PeerMsg{MsgInterested, make([]byte, 0)}); err != nil {
 		log.Println("failed to write interest message")
-		return
+		return err
 	}
-	for task := range taskCh {
-		// 连接的peer没有这一片，放回channel
-		if !conn.Field.HasPiece(task.index) {
-			taskCh <- task
-			continue
+	for {
+		// 可能被其他连接封禁
+		if t.blocked(conn.peer.IP) {
+			return errBanned
+		}
+		// 只分配连接的peer拥有的piece
+		idx, ok := t.pk.next(conn.Field.HasPiece)
+		if !ok {
+			return nil
 		}
-		log.Printf("get task, index: %v, peer: %v\n", task.index, peer.IP.String())
-		res, err := downloadPiece(conn, task)
+		log.Printf("get task, index: %v, peer: %v\n", idx, conn.peer.IP.String())
+		begin, end := t.getPieceBounds(idx)
+		res, err := downloadPiece(conn, &pieceTask{idx, end - begin})
 		if err != nil {
-			taskCh <- task
+			// 连接多半已经不可用，放回去给其他peer
+			t.pk.giveBack(idx)
 			log.Printf("fail to download piece: %v\n", err)
+			if t.ctx.Err() != nil {
+				return nil
+			}
+			return err
 		}
-		if !checkPiece(task, res) {
-			taskCh <- task
+		// piece的所有block都来自这个连接，校验结果记在对方的ip上
+		if !t.checkPiece(res, conn.peer.String(), conn.peer.IP) {
+			t.pk.giveBack(idx)
 			continue
 		}
-		resultCh <- res
+		if !t.deliver(res) {
+			return nil
+		}
 	}
 }
 
-func checkPiece(task *pieceTask, res *pieceResult) bool {
-	sha := sha1.Sum(res.data)
-	if !bytes.Equal(task.sha[:], sha[:]) {
+// checkPiece 有v1哈希时用sha1，有v2哈希时也用merkle根，from是数据的来源，
+// ip不为空时记录校验结果，坏数据太多的ip被封禁，v2 piece之后通过时再逐块找出坏块
+func (t *TorrentTask) checkPiece(res *pieceResult, from string, ip net.IP) bool {
+	ok := checkPieceHash(res.index, res.data, t.PieceSHA, t.PieceSHA256, t.Files, t.PieceLen)
+	if fileData := t.v2Data(res); fileData != nil {
+		if ok {
+			t.findCorruptBlocks(res.index, fileData)
+		} else {
+			t.rememberFailed(res.index, fileData, from)
+		}
+	}
+	if ip != nil && !t.Bans.Banned(ip) && t.Bans.record(ip, ok) {
+		log.Printf("ban peer %s: sent %d corrupt pieces\n", ip, MaxHashFails)
+		t.events.publish(PeerBanned{IP: ip})
+	}
+	if !ok {
 		log.Printf("check integrity failed, index :%v\n", res.index)
+		atomic.AddInt64(&t.stats.wasted, int64(len(res.data)))
+		t.events.publish(PieceFailed{Index: res.index, From: from})
 		return false
 	}
+	atomic.AddInt64(&t.stats.downloaded, int64(len(res.data)))
+	t.events.publish(PieceVerified{Index: res.index, Length: len(res.data), From: from})
 	return true
 }
 
+type failedPiece struct {
+	data []byte
+	from string
+}
+
+// v2Data piece中属于文件本身的数据，没有v2哈希时返回nil
+func (t *TorrentTask) v2Data(res *pieceResult) []byte {
+	if res.index >= len(t.PieceSHA256) || t.PieceSHA256[res.index].Leaves == 0 {
+		return nil
+	}
+	return res.data[:fileDataLen(t.Files, res.index*t.PieceLen, len(res.data))]
+}
+
+// rememberFailed 保存失败的数据，每个piece最多保留MaxHashFails份
+func (t *TorrentTask) rememberFailed(idx int, data []byte, from string) {
+	t.failMu.Lock()
+	defer t.failMu.Unlock()
+	if t.failed == nil {
+		t.failed = make(map[int][]failedPiece)
+	}
+	list := append(t.failed[idx], failedPiece{data, from})
+	if len(list) > MaxHashFails {
+		list = list[len(list)-MaxHashFails:]
+	}
+	t.failed[idx] = list
+}
+
+// findCorruptBlocks piece通过校验后，找出之前每次失败中具体哪些块是坏的以及来源
+func (t *TorrentTask) findCorruptBlocks(idx int, good []byte) {
+	t.failMu.Lock()
+	list := t.failed[idx]
+	delete(t.failed, idx)
+	t.failMu.Unlock()
+	for _, f := range list {
+		blocks := corruptBlocks(f.data, good, t.PieceSHA256[idx])
+		log.Printf("piece %d from %s had corrupt blocks %v\n", idx, f.from, blocks)
+		t.events.publish(CorruptBlocks{Index: idx, Blocks: blocks, From: f.from})
+	}
+}
+
 func downloadPiece(conn *PeerConn, task *pieceTask) (*pieceResult, error) {
 	// piece下载中间状态
 	state := &taskState{
@@ -206,9 +519,10 @@ func downloadPiece(conn *PeerConn, task *pieceTask) (*pieceResult, error) {
 				state.backlog++
 				state.requested += length
 			}
-			if err := state.handleMsg(); err != nil {
-				return nil, err
-			}
+		}
+		// choked时也要读消息，等对端unchoke
+		if err := state.handleMsg(); err != nil {
+			return nil, err
 		}
 	}
 	return &pieceResult{state.index, state.data}, nil
@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadCancel(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	// 一直不返回的web seed，只有请求被取消才结束
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.WebSeeds = []string{srv.URL + "/a.txt"}
+	task.Dir = t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, Download(ctx, task))
+	assert.True(t, time.Since(start) < 5*time.Second)
+	// 已经停止的任务再次下载直接返回
+	assert.Equal(t, ErrStopped, Download(context.Background(), task))
+}
+
+func TestDownloadSkipAll(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"b.txt"}, []byte("world!")},
+	})))
+	// 没有peer，Download一直等待results
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.Dir = t.TempDir()
+	done := make(chan error, 1)
+	go func() {
+		done <- Download(context.Background(), task)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	task.SetFilePriority(0, PrioritySkip)
+	task.SetFilePriority(1, PrioritySkip)
+	select {
+	case err := <-done:
+		assert.Equal(t, nil, err)
+	case <-time.After(5 * time.Second):
+		task.Stop()
+		t.Fatal("Download did not return after every file was skipped")
+	}
+}
+
+func TestAnnounceStopped(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	events := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event") + "/" + r.URL.Query().Get("trackerid")
+		_, _ = w.Write([]byte("d8:intervali900e10:tracker id3:abc5:peers0:e"))
+	}))
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+	// started得到的tracker id在stopped时带上
+	ids := make(map[[SHALEN]byte]string)
+	_, results, err := AnnounceTracker(context.Background(), tf, [IDLEN]byte{}, EventStarted, ids)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", results[0].TrackerID)
+	assert.Equal(t, EventStarted+"/", <-events)
+	assert.Equal(t, nil, AnnounceStopped(context.Background(), tf, [IDLEN]byte{}, ids))
+	assert.Equal(t, EventStopped+"/abc", <-events)
+
+	tf.Announce = ""
+	assert.Equal(t, ErrNoTracker, AnnounceStopped(context.Background(), tf, [IDLEN]byte{}, nil))
+}
+
+func TestDownloadTracker(t *testing.T) {
+	data := []byte("helloworld!0123456789")
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, data},
+	})))
+	var active, peak int64
+	seed := listenSeed(t, tf.InfoSHA, 4, data, &active, &peak)
+	compact := append(append([]byte{}, seed.IP.To4()...), byte(seed.Port>>8), byte(seed.Port))
+	var mu sync.Mutex
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := r.URL.Query().Get("event")
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+		// 第一次汇报没有peer，之后的才有
+		peers := ""
+		if event != EventStarted {
+			peers = string(compact)
+		}
+		_, _ = fmt.Fprintf(w, "d8:intervali1e5:peers%d:%se", len(peers), peers)
+	}))
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+	// 不通过Client，设置Tracker之后Download自己重新汇报
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.Dir = t.TempDir()
+	task.Tracker = tf
+	assert.Equal(t, 0, len(task.Announce(context.Background(), tf, EventStarted)))
+	assert.Equal(t, nil, Download(context.Background(), task))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{EventStarted, ""}, events[:2])
+	assert.Equal(t, EventStopped, events[len(events)-1])
+}
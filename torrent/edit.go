@@ -0,0 +1,146 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"go-torrent/bencode"
+	"io"
+	"sort"
+)
+
+// Metainfo 用于编辑种子文件，顶层的每个key都保留原始字节
+// 只修改顶层字段时info的字节不变，info hash也就不变
+type Metainfo struct {
+	fields map[string]bencode.RawMessage
+}
+
+func LoadMetainfo(r io.Reader) (*Metainfo, error) {
+	m := &Metainfo{}
+	if err := bencode.Unmarshal(r, &m.fields); err != nil {
+		return nil, err
+	}
+	if _, ok := m.fields["info"]; !ok {
+		return nil, errors.New("torrent has no info dict")
+	}
+	return m, nil
+}
+
+// InfoSHA 基于info的原始字节计算
+func (m *Metainfo) InfoSHA() [SHALEN]byte {
+	return sha1.Sum(m.fields["info"])
+}
+
+// Get 解析出顶层的某个字段，不存在时返回nil
+func (m *Metainfo) Get(key string) (*bencode.BObject, error) {
+	raw, ok := m.fields[key]
+	if !ok {
+		return nil, nil
+	}
+	return bencode.Parse(bytes.NewReader(raw))
+}
+
+// Set 设置顶层的字段，val为nil时删除，不允许通过Set修改info
+func (m *Metainfo) Set(key string, val *bencode.BObject) error {
+	if key == "info" {
+		return errors.New("use EditInfo to change the info dict")
+	}
+	if val == nil {
+		delete(m.fields, key)
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	if _, err := val.WriteTo(buf); err != nil {
+		return err
+	}
+	m.fields[key] = buf.Bytes()
+	return nil
+}
+
+func (m *Metainfo) SetAnnounce(url string) error {
+	if url == "" {
+		return m.Set("announce", nil)
+	}
+	return m.Set("announce", bencode.NewString(url))
+}
+
+// SetAnnounceList tiers为空时删除announce-list
+func (m *Metainfo) SetAnnounceList(tiers [][]string) error {
+	if len(tiers) == 0 {
+		return m.Set("announce-list", nil)
+	}
+	list := bencode.NewList()
+	for _, tier := range tiers {
+		_ = list.Append(stringList(tier))
+	}
+	return m.Set("announce-list", list)
+}
+
+func (m *Metainfo) SetComment(comment string) error {
+	if comment == "" {
+		return m.Set("comment", nil)
+	}
+	return m.Set("comment", bencode.NewString(comment))
+}
+
+// SetURLList 设置BEP 19的web seed，urls为空时删除
+func (m *Metainfo) SetURLList(urls []string) error {
+	if len(urls) == 0 {
+		return m.Set("url-list", nil)
+	}
+	return m.Set("url-list", stringList(urls))
+}
+
+func stringList(strs []string) *bencode.BObject {
+	list := bencode.NewList()
+	for _, s := range strs {
+		_ = list.Append(bencode.NewString(s))
+	}
+	return list
+}
+
+// EditInfo 修改info字典，fn之后info会被重新编码，info hash会改变，种子会变成另一个swarm
+func (m *Metainfo) EditInfo(fn func(info *bencode.BObject) error) error {
+	info, err := bencode.Parse(bytes.NewReader(m.fields["info"]))
+	if err != nil {
+		return err
+	}
+	if err = fn(info); err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if _, err = info.WriteTo(buf); err != nil {
+		return err
+	}
+	m.fields["info"] = buf.Bytes()
+	return nil
+}
+
+// WriteTo 按照key排序写出，未修改的字段原样写出
+func (m *Metainfo) WriteTo(w io.Writer) (int64, error) {
+	keys := make([]string, 0, len(m.fields))
+	for k := range m.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	bw := bufio.NewWriter(w)
+	var wLen int64
+	if err := bw.WriteByte('d'); err != nil {
+		return wLen, err
+	}
+	wLen++
+	for _, k := range keys {
+		wLen += int64(bencode.EncodeString(bw, k))
+		n, err := bw.Write(m.fields[k])
+		wLen += int64(n)
+		if err != nil {
+			return wLen, err
+		}
+	}
+	if err := bw.WriteByte('e'); err != nil {
+		return wLen, err
+	}
+	wLen++
+	return wLen, bw.Flush()
+}
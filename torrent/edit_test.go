@@ -0,0 +1,48 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"go-torrent/bencode"
+	"testing"
+)
+
+func TestEditKeepsInfo(t *testing.T) {
+	// info里的key没有按顺序排列，重新编码会改变info hash
+	info := "d6:pieces20:aaaaaaaaaaaaaaaaaaaa4:name1:n12:piece lengthi4e6:lengthi3ee"
+	in := "d8:announce10:http://old7:comment3:old4:info" + info + "e"
+	m, err := LoadMetainfo(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sha1.Sum([]byte(info)), m.InfoSHA())
+
+	assert.Equal(t, nil, m.SetAnnounce("http://new"))
+	assert.Equal(t, nil, m.SetAnnounceList([][]string{{"http://a", "http://b"}, {"http://c"}}))
+	assert.Equal(t, nil, m.SetComment(""))
+	assert.Equal(t, nil, m.SetURLList([]string{"http://seed/"}))
+	out := new(bytes.Buffer)
+	_, err = m.WriteTo(out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "d8:announce10:http://new13:announce-listll8:http://a8:http://bel8:http://cee"+
+		"4:info"+info+"8:url-listl12:http://seed/ee", out.String())
+
+	m2, err := LoadMetainfo(out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, m.InfoSHA(), m2.InfoSHA())
+	assert.NotEqual(t, nil, m2.Set("info", bencode.NewDict()))
+}
+
+func TestEditInfo(t *testing.T) {
+	info := "d4:name1:n7:privatei1ee"
+	m, _ := LoadMetainfo(bytes.NewBufferString("d4:info" + info + "e"))
+	before := m.InfoSHA()
+	err := m.EditInfo(func(info *bencode.BObject) error {
+		_ = info.Set("name", bencode.NewString("renamed"))
+		return info.Delete("private")
+	})
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, before, m.InfoSHA())
+	out := new(bytes.Buffer)
+	_, _ = m.WriteTo(out)
+	assert.Equal(t, "d4:infod4:name7:renamedee", out.String())
+}
@@ -0,0 +1,331 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatsInterval Download运行时发送Stats的间隔
+const StatsInterval = time.Second
+
+// 每个订阅者缓存的事件数，满了之后新的事件会被丢弃，PieceFailed和DownloadComplete除外
+const eventBuffer = 256
+
+// Event 订阅得到的事件，用类型断言区分
+type Event interface {
+	event()
+}
+
+// PieceVerified piece通过哈希校验，From是peer地址或者web seed的url
+type PieceVerified struct {
+	Index  int
+	Length int
+	From   string
+}
+
+// PieceFailed piece没有通过哈希校验，会重新分配下载
+type PieceFailed struct {
+	Index int
+	From  string
+}
+
+// CorruptBlocks 之前没有通过校验的v2 piece后来下载成功，用merkle树逐块校验之前的数据，
+// Blocks是From发来的坏块在piece中的序号，每块16KiB
+type CorruptBlocks struct {
+	Index  int
+	Blocks []int
+	From   string
+}
+
+type PeerConnected struct {
+	Peer PeerInfo
+}
+
+// PeerDisconnected Err为空表示没有需要这个peer下载的piece或者已经停止
+type PeerDisconnected struct {
+	Peer PeerInfo
+	Err  error
+}
+
+// PeerBanned ip发来的坏数据太多，断开并且不再连接
+type PeerBanned struct {
+	IP net.IP
+}
+
+// AnnounceResult 向tracker汇报的结果，hybrid种子的v2 swarm单独一次，
+// tracker没有回复的字段是零值
+type AnnounceResult struct {
+	Tracker string
+	Event   string
+	V2      bool
+	Peers   int
+	Err     error // 连接失败或者tracker回复了failure reason
+
+	Warning     string
+	Interval    int // 秒
+	MinInterval int
+	Complete    int // 做种的peer数
+	Incomplete  int // 还在下载的peer数
+	TrackerID   string
+}
+
+// DownloadComplete 需要的piece全部写入磁盘
+type DownloadComplete struct{}
+
+// Stats 下载进度的快照
+type Stats struct {
+	Pieces      int           // 需要下载的piece数
+	PiecesDone  int           // 其中已经完成的
+	BytesWanted int64         // 需要下载的字节数
+	BytesLeft   int64         // 其中还没有完成的
+	Downloaded  int64         // 收到并通过校验的字节数
+	Wasted      int64         // 没有通过校验被丢弃的字节数
+	Uploaded    int64         // 发给peer的字节数，目前不做种，只有协议消息
+	Peers       int           // 当前连接的peer数
+	Choked      int           // 其中choke了我们的
+	Rate        float64       // 最近的下载速度，字节每秒
+	UploadRate  float64       // 最近的上传速度
+	Elapsed     time.Duration // Download运行的时间
+}
+
+func (PieceVerified) event()    {}
+func (PieceFailed) event()      {}
+func (CorruptBlocks) event()    {}
+func (PeerConnected) event()    {}
+func (PeerDisconnected) event() {}
+func (PeerBanned) event()       {}
+func (AnnounceResult) event()   {}
+func (DownloadComplete) event() {}
+func (Stats) event()            {}
+
+// 关闭后还没送达的PieceFailed、DownloadComplete最多再等的时间，订阅者一直不读时不会永远挂着
+const drainTimeout = 5 * time.Second
+
+// terminal 不能丢弃的事件，订阅者靠它们判断结果
+func terminal(e Event) bool {
+	switch e.(type) {
+	case PieceFailed, DownloadComplete:
+		return true
+	}
+	return false
+}
+
+type subscriber struct {
+	ch      chan Event
+	pending []Event       // buffer满时暂存的terminal事件
+	quit    chan struct{} // 关闭后还在送达pending时，取消订阅用来通知停止
+}
+
+// flush 尽量把暂存的事件放进buffer，不阻塞
+func (s *subscriber) flush() {
+	for len(s.pending) > 0 {
+		select {
+		case s.ch <- s.pending[0]:
+			s.pending = s.pending[1:]
+		default:
+			return
+		}
+	}
+}
+
+// eventHub 把事件发给所有订阅者，不会因为订阅者处理慢而阻塞下载
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan Event]*subscriber
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]*subscriber)}
+}
+
+func (h *eventHub) subscribe() chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan Event, eventBuffer)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subs[ch] = &subscriber{ch: ch, quit: make(chan struct{})}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.subs[ch]
+	if !ok {
+		return
+	}
+	delete(h.subs, ch)
+	if h.closed {
+		// drain还在往ch发送，由它关闭ch
+		close(s.quit)
+		return
+	}
+	close(ch)
+}
+
+// publish buffer满时丢弃事件，terminal事件暂存起来之后再送达
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	for _, s := range h.subs {
+		s.flush()
+		if len(s.pending) == 0 {
+			select {
+			case s.ch <- e:
+				continue
+			default:
+			}
+		}
+		if terminal(e) {
+			s.pending = append(s.pending, e)
+		}
+	}
+}
+
+// close 关闭所有订阅的channel，之后的订阅直接得到关闭的channel，
+// 还有暂存事件的订阅者在事件送达之后才关闭
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch, s := range h.subs {
+		s.flush()
+		if len(s.pending) > 0 {
+			go h.drain(s)
+			continue
+		}
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// drain close之后把剩下的terminal事件送达，订阅者取消订阅或者超时后放弃
+func (h *eventHub) drain(s *subscriber) {
+	timer := time.NewTimer(drainTimeout)
+	defer timer.Stop()
+	// close之后publish不再修改pending
+	for _, e := range s.pending {
+		select {
+		case s.ch <- e:
+			continue
+		case <-s.quit:
+		case <-timer.C:
+		}
+		break
+	}
+	h.mu.Lock()
+	delete(h.subs, s.ch)
+	h.mu.Unlock()
+	close(s.ch)
+}
+
+// Subscribe 订阅下载事件，Download返回后channel关闭，提前不需要时调用返回的函数
+// 处理不及时的事件会被丢弃，Stats会定期发送，可以用来校正进度，
+// PieceFailed和DownloadComplete不会丢弃，在channel关闭前送达，除非一直不读
+func (t *TorrentTask) Subscribe() (<-chan Event, func()) {
+	t.prepare()
+	ch := t.events.subscribe()
+	return ch, func() {
+		t.events.unsubscribe(ch)
+	}
+}
+
+// taskStats Download过程中累计的计数
+type taskStats struct {
+	downloaded int64
+	wasted     int64
+	uploaded   int64
+	peers      int64
+	choked     int64
+
+	mu       sync.Mutex
+	start    time.Time
+	rate     float64
+	upRate   float64
+	lastTime time.Time
+	lastDown int64
+	lastUp   int64
+}
+
+// sample 根据上次采样以来下载和上传的字节数更新速度
+func (s *taskStats) sample(now time.Time) {
+	down := atomic.LoadInt64(&s.downloaded)
+	up := atomic.LoadInt64(&s.uploaded)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := now.Sub(s.lastTime); !s.lastTime.IsZero() && d > 0 {
+		s.rate = float64(down-s.lastDown) / d.Seconds()
+		s.upRate = float64(up-s.lastUp) / d.Seconds()
+	}
+	s.lastTime, s.lastDown, s.lastUp = now, down, up
+}
+
+// Stats 当前的下载进度
+func (t *TorrentTask) Stats() Stats {
+	t.prepare()
+	ret := Stats{
+		Downloaded: atomic.LoadInt64(&t.stats.downloaded),
+		Wasted:     atomic.LoadInt64(&t.stats.wasted),
+		Uploaded:   atomic.LoadInt64(&t.stats.uploaded),
+		Peers:      int(atomic.LoadInt64(&t.stats.peers)),
+		Choked:     int(atomic.LoadInt64(&t.stats.choked)),
+	}
+	t.stats.mu.Lock()
+	ret.Rate = t.stats.rate
+	ret.UploadRate = t.stats.upRate
+	if !t.stats.start.IsZero() {
+		ret.Elapsed = time.Since(t.stats.start)
+	}
+	t.stats.mu.Unlock()
+	for idx, st := range t.pk.snapshot() {
+		if st == stateSkip {
+			continue
+		}
+		begin, end := t.getPieceBounds(idx)
+		ret.Pieces++
+		ret.BytesWanted += int64(end - begin)
+		if st == stateDone {
+			ret.PiecesDone++
+		} else {
+			ret.BytesLeft += int64(end - begin)
+		}
+	}
+	return ret
+}
+
+// Completed 已经写入存储的piece
+func (t *TorrentTask) Completed() Bitfield {
+	t.prepare()
+	states := t.pk.snapshot()
+	field := make(Bitfield, (len(states)+7)/8)
+	for idx, st := range states {
+		if st == stateDone {
+			field.SetPiece(idx)
+		}
+	}
+	return field
+}
+
+// statsRoutine 定期采样下载速度并发送Stats，直到done关闭
+func (t *TorrentTask) statsRoutine(done <-chan struct{}) {
+	ticker := time.NewTicker(StatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.stats.sample(now)
+			t.events.publish(t.Stats())
+		case <-done:
+			return
+		}
+	}
+}
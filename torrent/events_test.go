@@ -0,0 +1,157 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"b.txt"}, []byte("world!")},
+	}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, files)))
+	srv := serveFiles("bundle", files, false)
+	defer srv.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.WebSeeds = []string{srv.URL}
+	task.Dir = t.TempDir()
+
+	events, _ := task.Subscribe()
+	assert.Equal(t, nil, Download(context.Background(), task))
+	var verified []int
+	var complete bool
+	var last Stats
+	// Download返回后channel关闭
+	for e := range events {
+		switch e := e.(type) {
+		case PieceVerified:
+			assert.Equal(t, srv.URL, e.From)
+			verified = append(verified, e.Index)
+		case DownloadComplete:
+			complete = true
+		case Stats:
+			last = e
+		}
+	}
+	sort.Ints(verified)
+	assert.Equal(t, []int{0, 1, 2}, verified)
+	assert.True(t, complete)
+	assert.Equal(t, 3, last.Pieces)
+	assert.Equal(t, 3, last.PiecesDone)
+	assert.Equal(t, int64(11), last.BytesWanted)
+	assert.Equal(t, int64(0), last.BytesLeft)
+	assert.Equal(t, int64(11), last.Downloaded)
+	assert.Equal(t, 0, last.Peers)
+
+	// 结束之后订阅得到关闭的channel
+	_, ok := <-func() <-chan Event {
+		ch, _ := task.Subscribe()
+		return ch
+	}()
+	assert.False(t, ok)
+}
+
+func TestEventsPieceFailed(t *testing.T) {
+	files := []testFile{{[]string{"a.txt"}, []byte("hello world")}}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, files)))
+	srv := serveFiles("bundle", files, true)
+	defer srv.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	ws, _ := newWebSeed(srv.URL+"/bundle/", task.Files)
+
+	events, cancel := task.Subscribe()
+	task.webSeedRoutine(ws)
+	cancel()
+	var failed int
+	var wasted int64
+	for e := range events {
+		if e, ok := e.(PieceFailed); ok {
+			failed++
+			begin, end := task.getPieceBounds(e.Index)
+			wasted += int64(end - begin)
+		}
+	}
+	assert.Equal(t, maxWebSeedFails, failed)
+	assert.Equal(t, wasted, task.Stats().Wasted)
+}
+
+func TestEventsTerminal(t *testing.T) {
+	h := newEventHub()
+	ch := h.subscribe()
+	// 不读取，buffer满了之后普通事件丢弃，terminal事件暂存
+	for i := 0; i < eventBuffer+10; i++ {
+		h.publish(PieceVerified{Index: i})
+	}
+	h.publish(PieceFailed{Index: 1})
+	h.publish(PieceVerified{Index: -1})
+	h.publish(DownloadComplete{})
+	h.close()
+	var got []Event
+	for e := range ch {
+		got = append(got, e)
+	}
+	assert.Equal(t, eventBuffer+2, len(got))
+	assert.Equal(t, PieceVerified{Index: eventBuffer - 1}, got[eventBuffer-1])
+	assert.Equal(t, []Event{PieceFailed{Index: 1}, DownloadComplete{}}, got[eventBuffer:])
+
+	// 送达剩下的事件时取消订阅，channel仍然会关闭
+	h = newEventHub()
+	ch = h.subscribe()
+	for i := 0; i < eventBuffer; i++ {
+		h.publish(PieceVerified{Index: i})
+	}
+	h.publish(DownloadComplete{})
+	h.close()
+	h.unsubscribe(ch)
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.True(t, n >= eventBuffer)
+}
+
+func TestEventsAnnounce(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("d8:intervali900e5:peers12:\x7f\x00\x00\x01\x1a\x0a\x7f\x00\x00\x02\x1a\x0be"))
+	}))
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	events, cancel := task.Subscribe()
+	defer cancel()
+	peers := task.Announce(context.Background(), tf, EventStarted)
+	assert.Equal(t, 2, len(peers))
+	assert.Equal(t, "127.0.0.2:6667", peers[1].String())
+	assert.Equal(t, AnnounceResult{Tracker: tf.Announce, Event: EventStarted, Peers: 2, Interval: 900}, <-events)
+}
+
+func TestEventsUpload(t *testing.T) {
+	data := []byte("helloworld!0123456789")
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, data},
+	})))
+	var active, peak int64
+	task := NewTask(tf, [IDLEN]byte{}, []PeerInfo{listenSeed(t, tf.InfoSHA, 4, data, &active, &peak)})
+	task.Dir = t.TempDir()
+	assert.Equal(t, nil, Download(context.Background(), task))
+	// interested和request消息都算作上传
+	s := task.Stats()
+	assert.True(t, s.Uploaded > 0)
+
+	now := time.Now()
+	task.stats.sample(now)
+	atomic.AddInt64(&task.stats.uploaded, 1000)
+	task.stats.sample(now.Add(time.Second))
+	assert.Equal(t, 1000.0, task.Stats().UploadRate)
+}
@@ -10,9 +10,13 @@ const (
 	HsMsgLen = Reserved + SHALEN + IDLEN
 )
 
+// BEP 52: 保留位最后一个字节的0x10表示支持v2协议
+const v2Bit = 0x10
+
 // HandshakeMsg ori:握手消息分为五块，1：指定第二段长度，2：什么协议，3：预留扩展，4：想要下载文件的hash，5：client id
 type HandshakeMsg struct {
 	PreStr  string
+	Ext     [Reserved]byte // 预留扩展位
 	InfoSHA [SHALEN]byte
 	PeerId  [IDLEN]byte
 }
@@ -26,6 +30,16 @@ func NewHandshakeMsg(infoSHA, peerId [IDLEN]byte) *HandshakeMsg {
 	}
 }
 
+// SetV2 声明支持v2协议
+func (m *HandshakeMsg) SetV2() {
+	m.Ext[Reserved-1] |= v2Bit
+}
+
+// V2 对端是否支持v2协议
+func (m *HandshakeMsg) V2() bool {
+	return m.Ext[Reserved-1]&v2Bit != 0
+}
+
 // WriteHandshake HandshakeMsg ori:握手消息分为五块，1：指定第二段长度，2：什么协议，3：预留扩展，4：想要下载文件的hash，5：client id
 func WriteHandshake(w io.Writer, msg *HandshakeMsg) (int, error) {
 	// 1 byte for prelen,共68个byte
@@ -36,7 +50,7 @@ func WriteHandshake(w io.Writer, msg *HandshakeMsg) (int, error) {
 	// 什么协议
 	curr += copy(buf[curr:], msg.PreStr)
 	// 预留扩展
-	curr += copy(buf[curr:], make([]byte, Reserved))
+	curr += copy(buf[curr:], msg.Ext[:])
 	// 想要下载文件的hash
 	curr += copy(buf[curr:], msg.InfoSHA[:])
 	// client id
@@ -65,12 +79,15 @@ func ReadHandshake(r io.Reader) (*HandshakeMsg, error) {
 
 	var peerId [IDLEN]byte
 	var infoSHA [SHALEN]byte
+	var ext [Reserved]byte
 
+	copy(ext[:], msgBuf[prelen:prelen+Reserved])
 	copy(infoSHA[:], msgBuf[prelen+Reserved:prelen+Reserved+SHALEN])
 	copy(peerId[:], msgBuf[prelen+Reserved+SHALEN:])
 
 	return &HandshakeMsg{
 		PreStr:  string(msgBuf[0:prelen]),
+		Ext:     ext,
 		InfoSHA: infoSHA,
 		PeerId:  peerId,
 	}, nil
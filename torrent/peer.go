@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,13 +40,14 @@ type PeerConn struct {
 	net.Conn
 	Choked  bool // 不提供上传
 	Field   Bitfield
+	choked  *int64 // 不为空时随Choked变化计数，用来统计被choke的peer数
 	peer    PeerInfo
 	peerId  [IDLEN]byte
 	infoSHA [SHALEN]byte
 }
 
-// handshake 该过程进行了文件分片sha的校验
-func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte) error {
+// handshake 该过程进行了文件分片sha的校验，v2为true时声明支持v2协议
+func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte, v2 bool) error {
 	if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
 		return err
 	}
@@ -53,6 +56,9 @@ func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte) error {
 	}()
 	// 生成握手消息，68Bytes?
 	req := NewHandshakeMsg(infoSHA, peerId)
+	if v2 {
+		req.SetV2()
+	}
 	if _, err := WriteHandshake(conn, req); err != nil {
 		log.Println("send handshake failed")
 		return err
@@ -73,14 +79,21 @@ func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte) error {
 
 // NewConn 将client 和 peer之间的conn抽象成一个PeerConn
 func NewConn(peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte) (*PeerConn, error) {
+	return dialPeer(context.Background(), peer, infoSHA, peerId, false)
+}
+
+func dialPeer(ctx context.Context, peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte, v2 bool) (*PeerConn, error) {
 	// 连在一起
-	addr := net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	addr := peer.String()
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		log.Printf("set tcp conn failed: %s\n", addr)
 		return nil, err
 	}
-	if err = handshake(conn, infoSHA, peerId); err != nil {
+	defer watchConn(ctx, conn)()
+	if err = handshake(conn, infoSHA, peerId, v2); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 	c := &PeerConn{
@@ -93,12 +106,42 @@ func NewConn(peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte) (*PeerConn
 	// 发送一个peerMsg，获取对端的bitmap,记录到peerConn的字段
 	if err = fillBitfield(c); err != nil {
 		log.Println("fill bitfield failed")
+		_ = conn.Close()
 		return nil, err
 	}
 	return c, nil
 
 }
 
+func (c *PeerConn) setChoked(choked bool) {
+	if c.Choked == choked {
+		return
+	}
+	c.Choked = choked
+	if c.choked != nil {
+		if choked {
+			atomic.AddInt64(c.choked, 1)
+		} else {
+			atomic.AddInt64(c.choked, -1)
+		}
+	}
+}
+
+// watchConn ctx取消时关闭conn，返回的函数用来停止监视
+func watchConn(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
 func fillBitfield(c *PeerConn) error {
 	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
 		return err
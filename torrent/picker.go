@@ -0,0 +1,367 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStopped 下载已经结束，等待中的数据不会再到达
+var ErrStopped = errors.New("torrent: download stopped")
+
+// Priority 文件的下载优先级，没有设置时都是PriorityNormal
+type Priority int8
+
+const (
+	PrioritySkip Priority = iota // 不下载
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return "unknown"
+}
+
+// ParsePriority 解析skip/low/normal/high
+func ParsePriority(s string) (Priority, error) {
+	for p := PrioritySkip; p <= PriorityHigh; p++ {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return PrioritySkip, fmt.Errorf("unknown priority: %s", s)
+}
+
+// filePriority 第i个文件的优先级，填充文件总是不需要
+func (t *TorrentTask) filePriority(i int) Priority {
+	if t.files()[i].Padding {
+		return PrioritySkip
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Priorities == nil {
+		return PriorityNormal
+	}
+	if i < len(t.Priorities) {
+		return t.Priorities[i]
+	}
+	return PriorityNormal
+}
+
+// piecePriorities 每个piece取和它重叠的文件中最高的优先级，和跳过的文件共用的边界piece仍然需要下载
+func (t *TorrentTask) piecePriorities() []Priority {
+	prio := make([]Priority, t.pieceCount())
+	for i, f := range t.files() {
+		p := t.filePriority(i)
+		for _, idx := range filePieces(t.PieceLen, f) {
+			if idx < len(prio) && p > prio[idx] {
+				prio[idx] = p
+			}
+		}
+	}
+	return prio
+}
+
+// skipped 不需要写到磁盘的文件
+func (t *TorrentTask) skipped() []bool {
+	ret := make([]bool, len(t.files()))
+	for i := range ret {
+		ret[i] = t.filePriority(i) == PrioritySkip
+	}
+	return ret
+}
+
+// SetFilePriority 运行中修改文件的优先级，从skip改为需要时，和其他文件共用的已完成piece会重新下载
+func (t *TorrentTask) SetFilePriority(i int, p Priority) {
+	if i < 0 || i >= len(t.files()) || t.files()[i].Padding {
+		return
+	}
+	t.prepare()
+	old := t.filePriority(i)
+	t.mu.Lock()
+	for len(t.Priorities) < len(t.files()) {
+		t.Priorities = append(t.Priorities, PriorityNormal)
+	}
+	t.Priorities[i] = p
+	t.mu.Unlock()
+	t.store.setSkip(i, p == PrioritySkip)
+	var redo []int
+	if old == PrioritySkip && p != PrioritySkip {
+		redo = filePieces(t.PieceLen, t.files()[i])
+	}
+	t.pk.update(t.piecePriorities(), redo)
+}
+
+type pieceState uint8
+
+const (
+	statePending pieceState = iota
+	stateActive             // 正在被某个peer下载
+	stateDone               // 已经校验并写入存储
+	stateSkip               // 不需要下载
+)
+
+// window 读取位置之后的一段piece，优先于所有优先级下载
+type window struct {
+	first int
+	count int
+}
+
+// picker 按优先级分配需要下载的piece，替代原来的taskCh
+type picker struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	prio       []Priority
+	state      []pieceState
+	left       int  // 需要下载但还没完成的piece数
+	sequential bool // 相同优先级时按序号顺序下载，否则从随机位置开始
+	rnd        *rand.Rand
+	windows    map[interface{}]window
+	paused     bool // 暂停时不再分配新的piece
+	closed     bool
+	emptied    chan struct{} // 修改优先级或者放回piece之后left变成0时通知Download
+}
+
+func newPicker(prio []Priority) *picker {
+	p := &picker{
+		prio:    prio,
+		state:   make([]pieceState, len(prio)),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		windows: make(map[interface{}]window),
+		emptied: make(chan struct{}, 1),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for idx, pr := range prio {
+		if pr == PrioritySkip {
+			p.state[idx] = stateSkip
+			continue
+		}
+		p.left++
+	}
+	return p
+}
+
+// pick 优先选离读取位置最近的piece，其次是优先级最高的，没有时返回-1
+func (p *picker) pick(has func(int) bool) int {
+	want := func(idx int) bool {
+		return idx < len(p.state) && p.state[idx] == statePending && has(idx)
+	}
+	best, dist := -1, 0
+	for _, w := range p.windows {
+		for i := 0; i < w.count && (best < 0 || i < dist); i++ {
+			if want(w.first + i) {
+				best, dist = w.first+i, i
+				break
+			}
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+	n := len(p.state)
+	start := 0
+	if !p.sequential && n > 0 {
+		start = p.rnd.Intn(n)
+	}
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		if want(idx) && (best < 0 || p.prio[idx] > p.prio[best]) {
+			best = idx
+		}
+	}
+	return best
+}
+
+// next 阻塞直到有has中的待下载piece，全部完成或者关闭后返回false
+func (p *picker) next(has func(int) bool) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.left == 0 || p.closed {
+			return -1, false
+		}
+		if p.paused {
+			p.cond.Wait()
+			continue
+		}
+		if idx := p.pick(has); idx >= 0 {
+			p.state[idx] = stateActive
+			return idx, true
+		}
+		p.cond.Wait()
+	}
+}
+
+// giveBack 下载或者校验失败，放回去给其他peer，下载期间改成skip的不再下载
+func (p *picker) giveBack(idx int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[idx] == stateActive {
+		if p.prio[idx] == PrioritySkip {
+			p.state[idx] = stateSkip
+			p.left--
+			p.notifyEmpty()
+		} else {
+			p.state[idx] = statePending
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// notifyEmpty 需要下载的piece都没有了，Download可能正在等待results，需要唤醒
+func (p *picker) notifyEmpty() {
+	if p.left != 0 {
+		return
+	}
+	select {
+	case p.emptied <- struct{}{}:
+	default:
+	}
+}
+
+// finish 已经写入存储
+func (p *picker) finish(idx int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[idx] != stateDone && p.state[idx] != stateSkip {
+		p.left--
+	}
+	p.state[idx] = stateDone
+	p.cond.Broadcast()
+}
+
+func (p *picker) setPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+	p.cond.Broadcast()
+}
+
+func (p *picker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// remaining 还没有完成的piece数
+func (p *picker) remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.left
+}
+
+// wanted 需要下载的piece总数
+func (p *picker) wanted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cnt := 0
+	for _, st := range p.state {
+		if st != stateSkip {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// snapshot 每个piece当前的状态
+func (p *picker) snapshot() []pieceState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ret := make([]pieceState, len(p.state))
+	copy(ret, p.state)
+	return ret
+}
+
+// update 运行中修改优先级，redo中已经完成的piece重新下载，
+// 正在下载的piece改成skip时仍然可以完成，失败后由giveBack跳过
+func (p *picker) update(prio []Priority, redo []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for idx, pr := range prio {
+		switch st := p.state[idx]; {
+		case st == stateSkip && pr != PrioritySkip:
+			p.state[idx] = statePending
+			p.left++
+		case st == statePending && pr == PrioritySkip:
+			p.state[idx] = stateSkip
+			p.left--
+		}
+	}
+	for _, idx := range redo {
+		if p.state[idx] == stateDone {
+			p.state[idx] = statePending
+			p.left++
+		}
+	}
+	p.prio = prio
+	p.notifyEmpty()
+	p.cond.Broadcast()
+}
+
+// setWindow key对应的读取位置，count为0时删除
+func (p *picker) setWindow(key interface{}, first, count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if count <= 0 {
+		delete(p.windows, key)
+	} else {
+		p.windows[key] = window{first, count}
+	}
+	p.cond.Broadcast()
+}
+
+// done piece是否已经写入存储
+func (p *picker) done(idx int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state[idx] == stateDone
+}
+
+// waitDone 阻塞直到piece写入存储，ctx取消时返回ctx.Err()
+func (p *picker) waitDone(ctx context.Context, idx int) error {
+	if ctx.Done() != nil {
+		// cond不能和channel一起select，取消时唤醒所有等待者重新检查
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.mu.Lock()
+				p.cond.Broadcast()
+				p.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.state[idx] != stateDone {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p.closed {
+			return ErrStopped
+		}
+		if p.state[idx] == stateSkip {
+			return fmt.Errorf("piece %d is not wanted", idx)
+		}
+		p.cond.Wait()
+	}
+	return nil
+}
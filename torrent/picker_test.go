@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPiecePriorities(t *testing.T) {
+	// 整体是 hell|owor|ld!0|1234|5678|9
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"b.txt"}, []byte("world!")},
+		{[]string{"c.txt"}, []byte("0123456789")},
+	})))
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	assert.Equal(t, []Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal},
+		task.piecePriorities())
+
+	// 边界piece取重叠文件中最高的优先级
+	task.Priorities = []Priority{PrioritySkip, PriorityHigh, PriorityLow}
+	assert.Equal(t, []Priority{PrioritySkip, PriorityHigh, PriorityHigh, PriorityLow, PriorityLow, PriorityLow},
+		task.piecePriorities())
+
+	pk := newPicker(task.piecePriorities())
+	pk.sequential = true
+	assert.Equal(t, 5, pk.wanted())
+	all := func(int) bool { return true }
+	idx, _ := pk.next(all)
+	assert.Equal(t, 1, idx)
+	idx, _ = pk.next(all)
+	assert.Equal(t, 2, idx)
+	// peer没有的piece不会分配
+	idx, _ = pk.next(func(i int) bool { return i == 5 })
+	assert.Equal(t, 5, idx)
+	pk.giveBack(1)
+	idx, _ = pk.next(all)
+	assert.Equal(t, 1, idx)
+	for _, i := range []int{1, 2, 3, 4, 5} {
+		pk.finish(i)
+	}
+	_, ok := pk.next(all)
+	assert.False(t, ok)
+
+	p, err := ParsePriority("HIGH")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, PriorityHigh, p)
+	_, err = ParsePriority("urgent")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPickerSkipActive(t *testing.T) {
+	pk := newPicker([]Priority{PriorityNormal, PriorityNormal})
+	pk.sequential = true
+	all := func(int) bool { return true }
+	idx, _ := pk.next(all)
+	assert.Equal(t, 0, idx)
+	// 下载中改成skip，失败之后不再分配
+	pk.update([]Priority{PrioritySkip, PriorityNormal}, nil)
+	pk.giveBack(0)
+	assert.Equal(t, 1, pk.remaining())
+	idx, _ = pk.next(all)
+	assert.Equal(t, 1, idx)
+	pk.giveBack(1)
+	idx, _ = pk.next(all)
+	assert.Equal(t, 1, idx)
+	pk.finish(1)
+	_, ok := pk.next(all)
+	assert.False(t, ok)
+	assert.Equal(t, stateSkip, pk.snapshot()[0])
+}
+
+func TestSelectiveDownload(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"b.txt"}, []byte("world!")},
+		{[]string{"c.txt"}, []byte("0123456789")},
+	}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, files)))
+	srv := serveFiles("bundle", files, false)
+	defer srv.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.WebSeeds = []string{srv.URL}
+	task.Dir = t.TempDir()
+	task.Priorities = []Priority{PrioritySkip, PriorityNormal, PrioritySkip}
+	assert.Equal(t, nil, Download(context.Background(), task))
+
+	// 和b.txt共用piece的a.txt和c.txt不会被创建
+	_, err := os.Stat(filepath.Join(task.Dir, "bundle", "a.txt"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(task.Dir, "bundle", "c.txt"))
+	assert.True(t, os.IsNotExist(err))
+	data, err := os.ReadFile(filepath.Join(task.Dir, "bundle", "b.txt"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "world!", string(data))
+}
@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go-torrent/bencode"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrivateFlagPreserved(t *testing.T) {
+	in := "d4:infod6:lengthi3e4:name1:n12:piece lengthi4e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:privatei1eee"
+	m, err := LoadMetainfo(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	err = m.EditInfo(func(info *bencode.BObject) error {
+		return info.Set("name", bencode.NewString("renamed"))
+	})
+	assert.Equal(t, nil, err)
+	out := new(bytes.Buffer)
+	_, _ = m.WriteTo(out)
+	tf, err := ParseFile(out)
+	assert.Equal(t, nil, err)
+	assert.True(t, tf.Private)
+	assert.True(t, NewTask(tf, [IDLEN]byte{}, nil).Private)
+}
+
+func TestPrivateRefusesPeers(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	peer := PeerInfo{IP: net.ParseIP("127.0.0.2"), Port: 6881}
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	assert.Equal(t, nil, task.AddPeers([]PeerInfo{peer}))
+	assert.Equal(t, 1, len(task.conns.order))
+
+	// 私有种子不接受tracker以外的peer
+	task = NewTask(tf, [IDLEN]byte{}, nil)
+	task.Private = true
+	assert.Equal(t, ErrPrivate, task.AddPeers([]PeerInfo{peer}))
+	task.prepare()
+	assert.Equal(t, 0, len(task.conns.order))
+
+	// tracker给的可以
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("d8:intervali900e5:peers6:\x7f\x00\x00\x02\x1a\xe1e"))
+	}))
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+	task.Announce(context.Background(), tf, EventStarted)
+	assert.Equal(t, []string{peer.String()}, task.conns.order)
+}
@@ -0,0 +1,231 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 每次读写最多这么多字节，多个peer轮流拿到令牌
+const limitChunk = BlockSize
+
+// Limiter 令牌桶限速，单位是字节每秒，rate<=0表示不限速，可以在运行中修改
+// 令牌不够时先欠着，后面的请求等待更久，所以等待的顺序和请求的顺序一致
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate int) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate 修改速度，已经在等待的请求不受影响
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate <= 0 {
+		l.rate = 0
+		return
+	}
+	if l.rate == 0 {
+		// 从不限速改为限速，桶里没有令牌
+		l.tokens, l.last = 0, time.Now()
+	}
+	l.rate = float64(rate)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+// reserve 取走n个令牌，返回需要等待的时间
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	// 最多攒一秒的令牌
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// waitLimits 在所有限速上取走n个令牌，按最慢的等待，返回等待的时间
+func waitLimits(ctx context.Context, limiters []*Limiter, n int) (time.Duration, error) {
+	var d time.Duration
+	for _, l := range limiters {
+		if w := l.reserve(n); w > d {
+			d = w
+		}
+	}
+	if d == 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return d, nil
+	case <-ctx.Done():
+		return d, ctx.Err()
+	}
+}
+
+// limitedConn 限制PeerConn的读写速度，限速等待的时间不算在deadline里
+type limitedConn struct {
+	net.Conn
+	ctx  context.Context
+	down []*Limiter
+	up   []*Limiter
+	sent *int64 // 写出的字节数累加到这里，为空时不统计
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		// 读到之后再等待，下一次读取被推迟，对端的发送由tcp的流控限制
+		d, werr := waitLimits(c.ctx, c.down, n)
+		if err == nil {
+			err = werr
+		}
+		c.mu.Lock()
+		if d > 0 && !c.readDeadline.IsZero() {
+			c.readDeadline = c.readDeadline.Add(d)
+			_ = c.Conn.SetReadDeadline(c.readDeadline)
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > limitChunk {
+			chunk = chunk[:limitChunk]
+		}
+		d, err := waitLimits(c.ctx, c.up, len(chunk))
+		if err != nil {
+			return written, err
+		}
+		c.mu.Lock()
+		if d > 0 && !c.writeDeadline.IsZero() {
+			c.writeDeadline = c.writeDeadline.Add(d)
+			_ = c.Conn.SetWriteDeadline(c.writeDeadline)
+		}
+		c.mu.Unlock()
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if c.sent != nil && n > 0 {
+			atomic.AddInt64(c.sent, int64(n))
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *limitedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *limitedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *limitedConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// limitedReader web seed的响应同样受下载限速
+type limitedReader struct {
+	io.Reader
+	ctx  context.Context
+	down []*Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if _, werr := waitLimits(r.ctx, r.down, n); err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// SetDownloadLimit 限制这个种子的下载速度，字节每秒，<=0不限速
+func (t *TorrentTask) SetDownloadLimit(rate int) {
+	t.prepare()
+	t.downLimit.SetRate(rate)
+}
+
+// SetUploadLimit 限制这个种子的上传速度，字节每秒，<=0不限速。
+// 目前不会给peer发送piece，只限制request等协议消息，实际几乎不起作用
+func (t *TorrentTask) SetUploadLimit(rate int) {
+	t.prepare()
+	t.upLimit.SetRate(rate)
+}
+
+// limiters 种子自己的限速在前，Client的全局限速在后
+func (t *TorrentTask) limiters(own, shared *Limiter) []*Limiter {
+	ret := []*Limiter{own}
+	if shared != nil {
+		ret = append(ret, shared)
+	}
+	return ret
+}
+
+// limitConn 连接的读写受种子和全局的限速
+func (t *TorrentTask) limitConn(conn net.Conn) net.Conn {
+	return &limitedConn{
+		Conn: conn,
+		ctx:  t.ctx,
+		down: t.limiters(t.downLimit, t.sharedDown),
+		up:   t.limiters(t.upLimit, t.sharedUp),
+		sent: &t.stats.uploaded,
+	}
+}
@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1000)
+	// 桶一开始是空的，欠下的令牌按顺序排队
+	d := l.reserve(500)
+	assert.InDelta(t, 500*time.Millisecond, d, float64(50*time.Millisecond))
+	d = l.reserve(500)
+	assert.InDelta(t, time.Second, d, float64(50*time.Millisecond))
+	l.SetRate(0)
+	assert.Equal(t, time.Duration(0), l.reserve(1<<20))
+	assert.Equal(t, 0, l.Rate())
+}
+
+func TestLimitedConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer func() {
+		_ = a.Close()
+		_ = b.Close()
+	}()
+	data := bytes.Repeat([]byte("x"), 2*BlockSize)
+	go func() {
+		_, _ = b.Write(data)
+	}()
+	c := &limitedConn{Conn: a, ctx: context.Background(), down: []*Limiter{NewLimiter(4 * BlockSize)}}
+	// 限速一共要等0.75秒，deadline随等待时间推迟
+	_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	buf := make([]byte, len(data))
+	_, err := io.ReadFull(c, buf)
+	assert.Equal(t, nil, err)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+}
+
+func TestDownloadLimit(t *testing.T) {
+	files := []testFile{{[]string{"a.bin"}, bytes.Repeat([]byte("0123456789abcdef"), BlockSize/8)}}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.bin", BlockSize, files)))
+	srv := serveFiles("bundle", files, false)
+	defer srv.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.WebSeeds = []string{srv.URL + "/bundle/"}
+	task.Dir = t.TempDir()
+	// 32KiB，每秒64KiB
+	task.SetDownloadLimit(4 * BlockSize)
+	start := time.Now()
+	assert.Equal(t, nil, Download(context.Background(), task))
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+}
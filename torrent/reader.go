@@ -0,0 +1,143 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultReadahead Reader读取位置之后优先下载的字节数
+const DefaultReadahead = 4 << 20
+
+// Reader 按整体的偏移读取种子数据，数据没有校验并写入之前会阻塞，
+// 同时读取位置之后的一段piece会优先下载，配合Sequential可以边下载边使用
+type Reader struct {
+	t         *TorrentTask
+	ctx       context.Context // 取消后阻塞的读取返回，不再影响下载顺序
+	mu        sync.Mutex
+	pos       int64
+	readahead int64
+}
+
+// NewReader 可以在Download之前创建，用完需要Close
+func (t *TorrentTask) NewReader() *Reader {
+	return t.NewReaderContext(context.Background())
+}
+
+// NewReaderContext ctx取消后等待数据的读取返回ctx.Err()，比如http请求的客户端断开
+func (t *TorrentTask) NewReaderContext(ctx context.Context) *Reader {
+	t.prepare()
+	return &Reader{t: t, ctx: ctx, readahead: DefaultReadahead}
+}
+
+// SetReadahead 设置读取位置之后优先下载的字节数
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	r.readahead = n
+	pos := r.pos
+	r.mu.Unlock()
+	r.focus(pos)
+}
+
+// Size 整体的长度
+func (r *Reader) Size() int64 {
+	return int64(r.t.FileLen)
+}
+
+// focus 把读取位置告诉picker
+func (r *Reader) focus(off int64) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	r.mu.Lock()
+	readahead := r.readahead
+	r.mu.Unlock()
+	pieceLen := int64(r.t.PieceLen)
+	count := int((readahead + pieceLen - 1) / pieceLen)
+	if count < 1 {
+		count = 1
+	}
+	r.t.pk.setWindow(r, int(off/pieceLen), count)
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("torrent: negative offset")
+	}
+	size := r.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if off+n > size {
+		n = size - off
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	r.focus(off)
+	// 读到跳过的文件时改为需要下载
+	for i, f := range r.t.files() {
+		if _, _, _, ok := overlap(f, off, int(n)); ok && !f.Padding && r.t.filePriority(i) == PrioritySkip {
+			r.t.SetFilePriority(i, PriorityLow)
+		}
+	}
+	pieceLen := int64(r.t.PieceLen)
+	for idx := off / pieceLen; idx <= (off+n-1)/pieceLen; idx++ {
+		if err := r.t.pk.waitDone(r.ctx, int(idx)); err != nil {
+			if r.ctx.Err() != nil {
+				// 没有人再读了，读取位置之后的piece不再优先
+				_ = r.Close()
+			}
+			return 0, err
+		}
+	}
+	read, err := r.t.store.ReadAt(p[:n], off)
+	if err == nil && int(n) < len(p) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+	n, err := r.ReadAt(p, pos)
+	r.mu.Lock()
+	r.pos = pos + int64(n)
+	r.mu.Unlock()
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.Size()
+	default:
+		r.mu.Unlock()
+		return 0, errors.New("torrent: invalid whence")
+	}
+	if offset < 0 {
+		r.mu.Unlock()
+		return 0, errors.New("torrent: negative position")
+	}
+	r.pos = offset
+	r.mu.Unlock()
+	r.focus(offset)
+	return offset, nil
+}
+
+// Close 不再影响下载顺序
+func (r *Reader) Close() error {
+	r.t.pk.setWindow(r, 0, 0)
+	return nil
+}
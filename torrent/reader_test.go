@@ -0,0 +1,81 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPickerWindow(t *testing.T) {
+	prio := make([]Priority, 8)
+	for i := range prio {
+		prio[i] = PriorityNormal
+	}
+	pk := newPicker(prio)
+	pk.sequential = true
+	all := func(int) bool { return true }
+	pk.setWindow("a", 5, 2)
+	idx, _ := pk.next(all)
+	assert.Equal(t, 5, idx)
+	idx, _ = pk.next(all)
+	assert.Equal(t, 6, idx)
+	// 窗口内都已经分配，按顺序
+	idx, _ = pk.next(all)
+	assert.Equal(t, 0, idx)
+	pk.setWindow("a", 0, 0)
+	pk.setWindow("b", 3, 4)
+	idx, _ = pk.next(all)
+	assert.Equal(t, 3, idx)
+}
+
+func TestReader(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"b.txt"}, []byte("world!")},
+		{[]string{"c.txt"}, []byte("0123456789")},
+	}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, files)))
+	srv := serveFiles("bundle", files, false)
+	defer srv.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.WebSeeds = []string{srv.URL}
+	task.Dir = t.TempDir()
+	task.Sequential = true
+	task.Priorities = []Priority{PrioritySkip, PriorityNormal, PriorityNormal}
+
+	r := task.NewReader()
+	defer func() {
+		_ = r.Close()
+	}()
+	// 还没有开始下载，读取会阻塞，同时把跳过的a.txt改为需要
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 7)
+		n, _ := r.ReadAt(buf, 2)
+		got <- string(buf[:n])
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for task.filePriority(0) == PrioritySkip && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-got:
+		t.Fatal("read returned before data was downloaded")
+	default:
+	}
+
+	assert.Equal(t, nil, Download(context.Background(), task))
+	assert.Equal(t, "lloworl", <-got)
+
+	_, err := r.Seek(-4, io.SeekEnd)
+	assert.Equal(t, nil, err)
+	rest, err := io.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "6789", string(rest))
+	_, _ = r.Seek(0, io.SeekStart)
+	all, _ := io.ReadAll(r)
+	assert.Equal(t, "helloworld!0123456789", string(all))
+}
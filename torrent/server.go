@@ -0,0 +1,158 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server 通过http提供下载中的种子文件，支持Range请求
+//
+//	GET /                   所有种子
+//	GET /<info hash>/       种子中的文件
+//	GET /<info hash>/<序号>  文件内容，正在读取的位置附近的piece优先下载
+type Server struct {
+	mu    sync.RWMutex
+	tasks map[string]*TorrentTask
+}
+
+func NewServer() *Server {
+	return &Server{tasks: make(map[string]*TorrentTask)}
+}
+
+// Add 添加种子，Download需要另外启动
+func (s *Server) Add(t *TorrentTask) {
+	t.prepare()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[hex.EncodeToString(t.InfoSHA[:])] = t
+}
+
+func (s *Server) Remove(infoSHA [SHALEN]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tasks, hex.EncodeToString(infoSHA[:]))
+}
+
+type serverTorrent struct {
+	InfoHash string       `json:"info_hash"`
+	Name     string       `json:"name"`
+	Length   int          `json:"length"`
+	Files    []serverFile `json:"files,omitempty"`
+}
+
+type serverFile struct {
+	Index     int    `json:"index"`
+	Path      string `json:"path"`
+	Length    int    `json:"length"`
+	Completed int    `json:"completed"` // 已经校验的字节数
+	URL       string `json:"url"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		s.serveList(w)
+		return
+	}
+	s.mu.RLock()
+	t, ok := s.tasks[strings.ToLower(parts[0])]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		writeJSON(w, s.describe(parts[0], t, true))
+		return
+	}
+	idx, err := strconv.Atoi(parts[1])
+	files := t.files()
+	if err != nil || idx < 0 || idx >= len(files) || files[idx].Padding {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveFile(w, r, t, idx)
+}
+
+func (s *Server) serveList(w http.ResponseWriter) {
+	s.mu.RLock()
+	list := make([]serverTorrent, 0, len(s.tasks))
+	for hash, t := range s.tasks {
+		list = append(list, s.describe(hash, t, false))
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	writeJSON(w, list)
+}
+
+func (s *Server) describe(hash string, t *TorrentTask, withFiles bool) serverTorrent {
+	ret := serverTorrent{InfoHash: strings.ToLower(hash), Name: t.FileName, Length: t.FileLen}
+	if !withFiles {
+		return ret
+	}
+	for i, f := range t.files() {
+		if f.Padding {
+			continue
+		}
+		ret.Files = append(ret.Files, serverFile{
+			Index:     i,
+			Path:      strings.Join(f.Path, "/"),
+			Length:    f.Length,
+			Completed: t.completedBytes(f),
+			URL:       "/" + ret.InfoHash + "/" + strconv.Itoa(i),
+		})
+	}
+	return ret
+}
+
+// serveFile 每个请求使用单独的Reader，请求结束后不再影响下载顺序
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, t *TorrentTask, idx int) {
+	f := t.files()[idx]
+	// 客户端断开时不再等待数据
+	reader := t.NewReaderContext(r.Context())
+	defer func() {
+		_ = reader.Close()
+	}()
+	content := io.NewSectionReader(reader, int64(f.Offset), int64(f.Length))
+	// 文件名用来推断Content-Type
+	http.ServeContent(w, r, f.Path[len(f.Path)-1], time.Time{}, content)
+}
+
+// completedBytes 文件中已经校验的字节数
+func (t *TorrentTask) completedBytes(f FileInfo) int {
+	done := 0
+	for _, idx := range filePieces(t.PieceLen, f) {
+		if !t.pk.done(idx) {
+			continue
+		}
+		begin, end := t.getPieceBounds(idx)
+		if begin < f.Offset {
+			begin = f.Offset
+		}
+		if end > f.Offset+f.Length {
+			end = f.Offset + f.Length
+		}
+		done += end - begin
+	}
+	return done
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
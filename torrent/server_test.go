@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"sub", "b.txt"}, []byte("world!")},
+		{[]string{"c.txt"}, []byte("0123456789")},
+	}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, files)))
+	seed := serveFiles("bundle", files, false)
+	defer seed.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.WebSeeds = []string{seed.URL}
+	task.Dir = t.TempDir()
+
+	s := NewServer()
+	s.Add(task)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	hash := hex.EncodeToString(tf.InfoSHA[:])
+
+	// 下载开始之前发出的请求会等待数据
+	type result struct {
+		status int
+		body   string
+	}
+	got := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/"+hash+"/2", nil)
+		req.Header.Set("Range", "bytes=2-5")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			got <- result{}
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		got <- result{resp.StatusCode, string(body)}
+	}()
+	assert.Equal(t, nil, Download(context.Background(), task))
+	res := <-got
+	assert.Equal(t, http.StatusPartialContent, res.status)
+	assert.Equal(t, "2345", res.body)
+
+	resp, err := http.Get(srv.URL + "/" + hash + "/")
+	assert.Equal(t, nil, err)
+	var info serverTorrent
+	assert.Equal(t, nil, json.NewDecoder(resp.Body).Decode(&info))
+	_ = resp.Body.Close()
+	assert.Equal(t, "bundle", info.Name)
+	assert.Equal(t, 3, len(info.Files))
+	assert.Equal(t, "bundle/sub/b.txt", info.Files[1].Path)
+	assert.Equal(t, 6, info.Files[1].Completed)
+
+	resp, _ = http.Get(srv.URL + info.Files[1].URL)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, "world!", string(body))
+
+	resp, _ = http.Get(srv.URL + "/")
+	var list []serverTorrent
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	_ = resp.Body.Close()
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, hash, list[0].InfoHash)
+
+	resp, _ = http.Get(srv.URL + "/" + hash + "/9")
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServerCancel(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("helloworld")},
+	})))
+	// 没有peer，数据永远不会到达
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.Dir = t.TempDir()
+	s := NewServer()
+	s.Add(task)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/"+hex.EncodeToString(tf.InfoSHA[:])+"/0", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+		errCh <- err
+	}()
+	windows := func() int {
+		task.pk.mu.Lock()
+		defer task.pk.mu.Unlock()
+		return len(task.pk.windows)
+	}
+	// 等到请求开始等待数据
+	assert.Eventually(t, func() bool { return windows() == 1 }, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NotEqual(t, nil, <-errCh)
+	// 处理请求的goroutine返回，读取位置被删除
+	assert.Eventually(t, func() bool { return windows() == 0 }, time.Second, 10*time.Millisecond)
+}
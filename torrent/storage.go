@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileStorage 把种子里的文件按顺序拼接成一个整体，按整体的偏移读写，读写可以跨越多个文件
+type fileStorage struct {
+	dir    string
+	files  []FileInfo
+	create bool   // 写入时是否创建缺失的文件和目录
+	skip   []bool // 不写入的文件，为空时全部写入
+	mu     sync.Mutex
+	fds    []*os.File // 按需打开
+}
+
+func newFileStorage(dir string, files []FileInfo, create bool) *fileStorage {
+	return &fileStorage{
+		dir:    dir,
+		files:  files,
+		create: create,
+		fds:    make([]*os.File, len(files)),
+	}
+}
+
+// filePath 拼出文件在本地的路径，拒绝会跳出下载目录的路径
+func filePath(dir string, f FileInfo) (string, error) {
+	parts := make([]string, 0, len(f.Path)+1)
+	parts = append(parts, dir)
+	for _, p := range f.Path {
+		if p == "" || p == "." || p == ".." || strings.ContainsAny(p, `/\`) {
+			return "", fmt.Errorf("unsafe path in torrent: %q", strings.Join(f.Path, "/"))
+		}
+		parts = append(parts, p)
+	}
+	return filepath.Join(parts...), nil
+}
+
+func (s *fileStorage) skipped(i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skip != nil && s.skip[i]
+}
+
+func (s *fileStorage) setSkip(i int, skip bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.skip == nil {
+		s.skip = make([]bool, len(s.files))
+	}
+	s.skip[i] = skip
+}
+
+func (s *fileStorage) open(i int) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fds[i] != nil {
+		return s.fds[i], nil
+	}
+	path, err := filePath(s.dir, s.files[i])
+	if err != nil {
+		return nil, err
+	}
+	var fd *os.File
+	if s.create {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		fd, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		fd, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.fds[i] = fd
+	return fd, nil
+}
+
+// span 整体中[off, off+n)与第i个文件重叠的部分，返回在文件内的偏移和在p中的位置
+func (s *fileStorage) span(i int, off int64, n int) (fileOff int64, begin, end int, ok bool) {
+	return overlap(s.files[i], off, n)
+}
+
+// overlap 整体中[off, off+n)与文件f重叠的部分
+func overlap(f FileInfo, off int64, n int) (fileOff int64, begin, end int, ok bool) {
+	fBegin, fEnd := int64(f.Offset), int64(f.Offset+f.Length)
+	lo, hi := off, off+int64(n)
+	if lo < fBegin {
+		lo = fBegin
+	}
+	if hi > fEnd {
+		hi = fEnd
+	}
+	if lo >= hi {
+		return 0, 0, 0, false
+	}
+	return lo - fBegin, int(lo - off), int(hi - off), true
+}
+
+// ReadAt 文件不存在或者长度不够时返回错误，已经读到的字节数仍然有效
+func (s *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for i := range s.files {
+		fileOff, begin, end, ok := s.span(i, off, len(p))
+		if !ok {
+			continue
+		}
+		// 填充文件不在磁盘上，内容全是零
+		if s.files[i].Padding {
+			for j := begin; j < end; j++ {
+				p[j] = 0
+			}
+			read += end - begin
+			continue
+		}
+		fd, err := s.open(i)
+		if err != nil {
+			return read, err
+		}
+		n, err := fd.ReadAt(p[begin:end], fileOff)
+		read += n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return read, err
+		}
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (s *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	for i := range s.files {
+		fileOff, begin, end, ok := s.span(i, off, len(p))
+		if !ok {
+			continue
+		}
+		if s.files[i].Padding || s.skipped(i) {
+			written += end - begin
+			continue
+		}
+		fd, err := s.open(i)
+		if err != nil {
+			return written, err
+		}
+		n, err := fd.WriteAt(p[begin:end], fileOff)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Sync 把已经打开的文件刷到磁盘
+func (s *fileStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fd := range s.fds {
+		if fd == nil {
+			continue
+		}
+		if err := fd.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for i, fd := range s.fds {
+		if fd == nil {
+			continue
+		}
+		if err := fd.Close(); err != nil && first == nil {
+			first = err
+		}
+		s.fds[i] = nil
+	}
+	return first
+}
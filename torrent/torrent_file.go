@@ -3,65 +3,279 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"go-torrent/bencode"
 	"io"
 	"log"
+	"reflect"
+	"strings"
+	"time"
 )
 
+type rawFileInfo struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr"` // BEP 47，包含p时是对齐用的填充文件
+}
+
 type rawInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"` // 对应的值是文件以字节为单位的每个分片的长度
-	Pieces      string `bencode:"pieces"`       // 将字节序列按 20 个字节为一组切分开, 则每组都是文件相对应 piece 的 SHA1 哈希值
+	Files       []rawFileInfo    `bencode:"files"` // 多文件时才有，每个文件的长度和相对路径
+	Length      int              `bencode:"length"`
+	Name        string           `bencode:"name"`
+	PieceLength int              `bencode:"piece length"` // 对应的值是文件以字节为单位的每个分片的长度
+	Pieces      string           `bencode:"pieces"`       // 将字节序列按 20 个字节为一组切分开, 则每组都是文件相对应 piece 的 SHA1 哈希值
+	Private     int              `bencode:"private"`      // BEP 27，为1时只能从tracker获取peer
+	Source      string           `bencode:"source"`       // 一些私有tracker用来区分来源，会影响info hash
+	MetaVersion int              `bencode:"meta version"` // BEP 52，为2时是v2或者hybrid种子
+	FileTree    *bencode.BObject `bencode:"file tree"`    // v2的文件树，叶子中有pieces root
 }
 
 type rawFile struct {
-	Announce string  `bencode:"announce"`
-	Info     rawInfo `bencode:"info"`
+	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list"` // BEP 12，多层tracker
+	Comment      string             `bencode:"comment"`
+	CreatedBy    string             `bencode:"created by"`
+	CreationDate int64              `bencode:"creation date"` // unix时间戳
+	Encoding     string             `bencode:"encoding"`
+	URLList      *bencode.BObject   `bencode:"url-list"`     // BEP 19，可以是单个字符串或者列表
+	HTTPSeeds    []string           `bencode:"httpseeds"`    // BEP 17
+	Info         bencode.RawMessage `bencode:"info"`         // 保留原始字节，info的哈希必须基于原始编码计算
+	PieceLayers  map[string]string  `bencode:"piece layers"` // v2中超过一个piece的文件，pieces root到piece哈希的拼接
 }
 
 const SHALEN int = 20
 
+// FileInfo 种子中的一个文件，所有文件按顺序首尾相连组成整体，再切分成piece
+type FileInfo struct {
+	Path   []string // 相对下载目录的路径，多文件时第一段是种子的name
+	Length int
+	Offset int // 在整体中的起始位置
+
+	Padding    bool            // hybrid种子中对齐用的填充文件，内容全是零，不写到磁盘
+	PiecesRoot [SHA256LEN]byte // v2中文件merkle树的根
+}
+
 type TorrentFile struct {
 	Announce string       // tracker的url
-	InfoSHA  [SHALEN]byte // 需要下载文件的唯一标识
-	FileName string       // 本地文件的文件名
-	FileLen  int          // 文件长度
+	InfoSHA  [SHALEN]byte // 需要下载文件的唯一标识，纯v2种子是截断的sha256
+	FileName string       // 本地文件的文件名，多文件时是顶层目录名
+	FileLen  int          // 文件长度，多文件时是所有文件的总长度，纯v2种子包含文件之间对齐的空隙
 	PieceLen int
 	PieceSHA [][SHALEN]byte // 文件校验使用
+	Files    []FileInfo     // 单文件时只有一项
+	RawInfo  []byte         // info字典的原始编码
+
+	AnnounceList [][]string // 每一层是一组等价的tracker，没有时为空
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // 没有时为零值
+	Encoding     string
+	Private      bool
+	Source       string
+	URLList      []string // web seed
+	HTTPSeeds    []string
+
+	Extra     map[string]bencode.RawMessage // 顶层中没有识别的key，保留原始编码
+	InfoExtra map[string]bencode.RawMessage // info中没有识别的key
+
+	MetaVersion int             // 1或者2，hybrid种子是2且同时有PieceSHA
+	InfoSHA256  [SHA256LEN]byte // v2的info hash，v1种子为零值
+	PieceSHA256 []PieceHashV2   // v2每个piece的merkle根，按piece序号排列
+}
+
+// IsV2 可以加入v2的swarm
+func (tf *TorrentFile) IsV2() bool {
+	return tf.MetaVersion == 2
+}
+
+// IsHybrid 同时可以加入v1和v2的swarm
+func (tf *TorrentFile) IsHybrid() bool {
+	return tf.IsV2() && len(tf.PieceSHA) > 0
+}
+
+// InfoSHAV2 握手和tracker使用截断到20字节的v2 info hash
+func (tf *TorrentFile) InfoSHAV2() [SHALEN]byte {
+	var ret [SHALEN]byte
+	if tf.IsV2() {
+		copy(ret[:], tf.InfoSHA256[:])
+	}
+	return ret
+}
+
+// PieceCount piece的个数
+func (tf *TorrentFile) PieceCount() int {
+	return pieceCount(tf.PieceSHA, tf.PieceSHA256)
+}
+
+// PieceBounds 第idx个piece在整体中的起止位置
+func (tf *TorrentFile) PieceBounds(idx int) (begin, end int) {
+	if len(tf.PieceSHA) == 0 && tf.IsV2() {
+		return alignedBounds(tf.PieceLen, tf.Files, idx)
+	}
+	return pieceBounds(tf.PieceLen, tf.FileLen, idx)
+}
+
+// CheckPiece 校验第idx个piece的数据
+func (tf *TorrentFile) CheckPiece(idx int, data []byte) bool {
+	return checkPieceHash(idx, data, tf.PieceSHA, tf.PieceSHA256, tf.Files, tf.PieceLen)
 }
 
 func ParseFile(r io.Reader) (*TorrentFile, error) {
-	raw := &rawFile{}
-	err := bencode.Unmarshal(r, raw)
+	data, err := io.ReadAll(r)
 	if err != nil {
+		return nil, err
+	}
+	raw := &rawFile{}
+	if err = bencode.Unmarshal(bytes.NewReader(data), raw); err != nil {
 		log.Println("Fail to parse torrent file")
 		return nil, err
 	}
+	info := &rawInfo{}
+	if err = bencode.Unmarshal(bytes.NewReader(raw.Info), info); err != nil {
+		log.Println("Fail to parse torrent info")
+		return nil, err
+	}
+	if info.PieceLength <= 0 {
+		return nil, errors.New("invalid piece length")
+	}
 	ret := &TorrentFile{
-		Announce: raw.Announce,
-		FileName: raw.Info.Name,
-		FileLen:  raw.Info.Length,
-		PieceLen: raw.Info.PieceLength,
+		Announce:     raw.Announce,
+		FileName:     info.Name,
+		PieceLen:     info.PieceLength,
+		RawInfo:      raw.Info,
+		AnnounceList: raw.AnnounceList,
+		Comment:      raw.Comment,
+		CreatedBy:    raw.CreatedBy,
+		Encoding:     raw.Encoding,
+		Private:      info.Private == 1,
+		Source:       info.Source,
+		URLList:      stringOrList(raw.URLList),
+		HTTPSeeds:    raw.HTTPSeeds,
+	}
+	if raw.CreationDate > 0 {
+		ret.CreationDate = time.Unix(raw.CreationDate, 0)
+	}
+	if ret.Extra, err = extraKeys(data, reflect.TypeOf(rawFile{})); err != nil {
+		return nil, err
+	}
+	if ret.InfoExtra, err = extraKeys(raw.Info, reflect.TypeOf(rawInfo{})); err != nil {
+		return nil, err
+	}
+	switch info.MetaVersion {
+	case 0, 1:
+		ret.MetaVersion = 1
+	case 2:
+		ret.MetaVersion = 2
+	default:
+		return nil, fmt.Errorf("unsupported meta version %d", info.MetaVersion)
 	}
-
 	// 计算 info SHA
-	buf := new(bytes.Buffer)
-	// Marshal是不对的，应该要根据tag去做marshal
-	wlen := bencode.Marshal(buf, raw.Info)
-	if wlen == 0 {
-		log.Fatal("raw file info error")
+	ret.InfoSHA = sha1.Sum(raw.Info)
+	if !ret.IsV2() {
+		if err = ret.parseV1(info); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	// v2的info hash是原始info的sha256
+	ret.InfoSHA256 = sha256.Sum256(raw.Info)
+	files, err := parseV2(info.Name, info.PieceLength, info.FileTree, raw.PieceLayers)
+	if err != nil {
+		return nil, err
+	}
+	if info.Pieces == "" {
+		// 纯v2种子只能加入v2的swarm，使用截断的v2 info hash
+		ret.InfoSHA = ret.InfoSHAV2()
+		ret.Files, ret.PieceSHA256, ret.FileLen = layoutV2(files, ret.PieceLen)
+		return ret, nil
+	}
+	// hybrid种子同时有v1的文件列表和pieces
+	if err = ret.parseV1(info); err != nil {
+		return nil, err
+	}
+	if ret.PieceSHA256, err = attachV2(ret.Files, files, ret.PieceLen); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// parseV1 解析v1的文件列表和pieces
+func (tf *TorrentFile) parseV1(info *rawInfo) error {
+	// 单文件直接使用name，多文件放在name目录下
+	if len(info.Files) == 0 {
+		tf.Files = []FileInfo{{Path: []string{info.Name}, Length: info.Length}}
+	} else {
+		tf.Files = make([]FileInfo, len(info.Files))
+		for i, f := range info.Files {
+			tf.Files[i] = FileInfo{
+				Path:    append([]string{info.Name}, f.Path...),
+				Length:  f.Length,
+				Padding: strings.Contains(f.Attr, "p"),
+			}
+		}
+	}
+	for i := range tf.Files {
+		if tf.Files[i].Length < 0 {
+			return fmt.Errorf("invalid length of %v", tf.Files[i].Path)
+		}
+		tf.Files[i].Offset = tf.FileLen
+		tf.FileLen += tf.Files[i].Length
 	}
-	ret.InfoSHA = sha1.Sum(buf.Bytes())
 
 	// 计算 pieces SHA
 	// pieces在文件中读到
-	bys := []byte(raw.Info.Pieces)
+	bys := []byte(info.Pieces)
+	if len(bys)%SHALEN != 0 {
+		return errors.New("malformed pieces")
+	}
 	cnt := len(bys) / SHALEN
+	// 每个piece都要有哈希，多了少了都没法校验
+	if want := (tf.FileLen + tf.PieceLen - 1) / tf.PieceLen; cnt != want {
+		return fmt.Errorf("pieces has %d hashes, want %d", cnt, want)
+	}
 	hashes := make([][SHALEN]byte, cnt)
 	for i := 0; i < cnt; i++ {
 		copy(hashes[i][:], bys[i*SHALEN:(i+1)*SHALEN])
 	}
-	ret.PieceSHA = hashes
-	return ret, nil
+	tf.PieceSHA = hashes
+	return nil
+}
+
+// stringOrList url-list只有一个地址时可以直接是字符串
+func stringOrList(o *bencode.BObject) []string {
+	if o == nil {
+		return nil
+	}
+	if s, err := o.Str(); err == nil {
+		if s == "" {
+			return nil
+		}
+		return []string{s}
+	}
+	var ret []string
+	o.Each(func(_ int, elem *bencode.BObject) bool {
+		if s, err := elem.Str(); err == nil && s != "" {
+			ret = append(ret, s)
+		}
+		return true
+	})
+	return ret
+}
+
+// extraKeys 找出字典中结构体t没有声明的key，保留原始编码以便原样写回
+func extraKeys(data []byte, t reflect.Type) (map[string]bencode.RawMessage, error) {
+	fields := make(map[string]bencode.RawMessage)
+	if err := bencode.Unmarshal(bytes.NewReader(data), &fields); err != nil {
+		return nil, err
+	}
+	for i := 0; i < t.NumField(); i++ {
+		delete(fields, t.Field(i).Tag.Get("bencode"))
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
 }
@@ -2,7 +2,10 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha1"
 	"github.com/stretchr/testify/assert"
+	"go-torrent/bencode"
 	"os"
 	"testing"
 )
@@ -21,3 +24,128 @@ func TestParseFile(t *testing.T) {
 		0xce, 0xb6, 0xfb, 0x58, 0x61, 0x7e, 0x69, 0x95, 0xa7, 0xed, 0xdb}
 	assert.Equal(t, expectHASH, tf.InfoSHA)
 }
+
+type testFile struct {
+	path []string
+	data []byte
+}
+
+// makeTorrent 根据文件内容生成种子，files只有一项且path只有一段时生成单文件种子
+func makeTorrent(name string, pieceLen int, files []testFile) []byte {
+	var all []byte
+	for _, f := range files {
+		all = append(all, f.data...)
+	}
+	pieces := new(bytes.Buffer)
+	for begin := 0; begin < len(all); begin += pieceLen {
+		end := begin + pieceLen
+		if end > len(all) {
+			end = len(all)
+		}
+		sum := sha1.Sum(all[begin:end])
+		pieces.Write(sum[:])
+	}
+	info := bencode.NewDict()
+	_ = info.Set("name", bencode.NewString(name))
+	_ = info.Set("piece length", bencode.NewInt(int64(pieceLen)))
+	_ = info.Set("pieces", bencode.NewString(pieces.String()))
+	if len(files) == 1 && len(files[0].path) == 1 {
+		_ = info.Set("length", bencode.NewInt(int64(len(files[0].data))))
+	} else {
+		list := bencode.NewList()
+		for _, f := range files {
+			entry := bencode.NewDict()
+			_ = entry.Set("length", bencode.NewInt(int64(len(f.data))))
+			path := bencode.NewList()
+			for _, p := range f.path {
+				_ = path.Append(bencode.NewString(p))
+			}
+			_ = entry.Set("path", path)
+			_ = list.Append(entry)
+		}
+		_ = info.Set("files", list)
+	}
+	root := bencode.NewDict()
+	_ = root.Set("announce", bencode.NewString("http://127.0.0.1/announce"))
+	_ = root.Set("info", info)
+	buf := new(bytes.Buffer)
+	_, _ = root.WriteTo(buf)
+	return buf.Bytes()
+}
+
+func TestParseMultiFile(t *testing.T) {
+	data := makeTorrent("bundle", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"sub", "b.txt"}, []byte("world!")},
+	})
+	tf, err := ParseFile(bytes.NewReader(data))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bundle", tf.FileName)
+	assert.Equal(t, 11, tf.FileLen)
+	assert.Equal(t, 3, len(tf.PieceSHA))
+	assert.Equal(t, []FileInfo{
+		{Path: []string{"bundle", "a.txt"}, Length: 5, Offset: 0},
+		{Path: []string{"bundle", "sub", "b.txt"}, Length: 6, Offset: 5},
+	}, tf.Files)
+	// info hash基于原始info的编码
+	root, _ := bencode.Parse(bytes.NewReader(data))
+	info, _ := root.Get("info")
+	raw := new(bytes.Buffer)
+	_, _ = info.WriteTo(raw)
+	assert.Equal(t, sha1.Sum(raw.Bytes()), tf.InfoSHA)
+}
+
+// editInfo 修改makeTorrent生成的种子中info的内容
+func editInfo(data []byte, edit func(info *bencode.BObject)) []byte {
+	root, _ := bencode.Parse(bytes.NewReader(data))
+	info, _ := root.Get("info")
+	edit(info)
+	buf := new(bytes.Buffer)
+	_, _ = root.WriteTo(buf)
+	return buf.Bytes()
+}
+
+func TestParseMalformed(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"sub", "b.txt"}, []byte("world!")},
+	}
+	// 11字节只有一个piece的哈希
+	data := editInfo(makeTorrent("bundle", 4, files), func(info *bencode.BObject) {
+		_ = info.Set("pieces", bencode.NewString(string(make([]byte, SHALEN))))
+	})
+	_, err := ParseFile(bytes.NewReader(data))
+	assert.NotEqual(t, nil, err)
+
+	data = editInfo(makeTorrent("a.txt", 4, files[:1]), func(info *bencode.BObject) {
+		_ = info.Set("length", bencode.NewInt(-5))
+		_ = info.Set("pieces", bencode.NewString(""))
+	})
+	_, err = ParseFile(bytes.NewReader(data))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseMetadata(t *testing.T) {
+	file, _ := os.Open("../testfile/debian-iso.torrent")
+	tf, err := ParseFile(bufio.NewReader(file))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `"Debian CD from cdimage.debian.org"`, tf.Comment)
+	assert.Equal(t, int64(1639833767), tf.CreationDate.Unix())
+	assert.Equal(t, 2, len(tf.HTTPSeeds))
+	assert.False(t, tf.Private)
+	assert.Equal(t, 0, len(tf.Extra))
+
+	in := "d8:announce3:url10:created by4:test13:creation datei1600000000e8:encoding5:UTF-8" +
+		"4:infod6:lengthi3e4:name1:n12:piece lengthi4e6:pieces20:aaaaaaaaaaaaaaaaaaaa" +
+		"7:privatei1e6:source3:src6:x-infoi7ee8:url-list11:http://seed7:x-extrali1eee"
+	tf, err = ParseFile(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "test", tf.CreatedBy)
+	assert.Equal(t, int64(1600000000), tf.CreationDate.Unix())
+	assert.Equal(t, "UTF-8", tf.Encoding)
+	assert.True(t, tf.Private)
+	assert.Equal(t, "src", tf.Source)
+	assert.Equal(t, []string{"http://seed"}, tf.URLList)
+	assert.Equal(t, map[string]bencode.RawMessage{"x-extra": bencode.RawMessage("li1ee")}, tf.Extra)
+	assert.Equal(t, map[string]bencode.RawMessage{"x-info": bencode.RawMessage("i7e")}, tf.InfoExtra)
+}
@@ -1,8 +1,10 @@
 package torrent
 
 import (
-	"crypto/rand"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"go-torrent/bencode"
 	"log"
 	"net"
@@ -17,24 +19,48 @@ const (
 	IpLen    int = 4
 	PortLen  int = 2
 	PeerLen      = IpLen + PortLen
+	IPv6Len  int = 16
+	Peer6Len     = IPv6Len + PortLen
 )
 
 const IDLEN int = 20
 
+// 汇报给tracker的事件，定期汇报时为空
+const (
+	EventStarted   = "started"
+	EventStopped   = "stopped"
+	EventCompleted = "completed"
+)
+
 type PeerInfo struct {
 	IP   net.IP
 	Port uint16
+	V2   bool        // hybrid种子中从v2 swarm得到，握手时使用v2的info hash
+	ID   [IDLEN]byte // 非紧凑格式的回复中才有，否则是零值
+}
+
+// String ip:port，用来连接和显示，ipv6的地址加方括号，比如[::1]:6881
+func (p PeerInfo) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
 type TrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string           `bencode:"failure reason"` // 有这个key时请求失败，其他key可能都没有
+	WarningMessage string           `bencode:"warning message"`
+	Interval       int              `bencode:"interval"`
+	MinInterval    int              `bencode:"min interval"` // 两次汇报的最小间隔，秒
+	TrackerID      string           `bencode:"tracker id"`   // 之后的汇报要带上
+	Complete       int              `bencode:"complete"`     // 做种的peer数
+	Incomplete     int              `bencode:"incomplete"`   // 还在下载的peer数
+	Peers          *bencode.BObject `bencode:"peers"`        // 紧凑格式是字符串，否则是字典的列表
+	Peers6         string           `bencode:"peers6"`       // BEP 7，紧凑格式的ipv6 peer
 }
 
-func buildUrl(tf *TorrentFile, peerId [IDLEN]byte) (string, error) {
-	if _, err := rand.Read(peerId[:]); err != nil {
-		return "", err
-	}
+// 所有种子共用的tracker客户端
+var trackerClient = &http.Client{Timeout: 15 * time.Second}
+
+// buildUrl local是本机的公网地址，通过ipv4和ipv6参数告诉tracker，trackerId是上一次回复中的tracker id
+func buildUrl(tf *TorrentFile, infoSHA [SHALEN]byte, peerId [IDLEN]byte, port int, event string, local []net.IP, trackerId string) (string, error) {
 	// 转换成url
 	base, err := url.Parse(tf.Announce)
 	if err != nil {
@@ -44,11 +70,11 @@ func buildUrl(tf *TorrentFile, peerId [IDLEN]byte) (string, error) {
 	// 生成参数
 	params := url.Values{
 		// 文件标识
-		"info_hash": []string{string(tf.InfoSHA[:])},
+		"info_hash": []string{string(infoSHA[:])},
 		// 下载器标识
 		"peer_id": []string{string(peerId[:])},
 		// 端口
-		"port": []string{strconv.Itoa(PeerPort)},
+		"port": []string{strconv.Itoa(port)},
 		// 暂时无用，用默认值
 		"uploaded":   []string{"0"},
 		"downloaded": []string{"0"},
@@ -56,23 +82,219 @@ func buildUrl(tf *TorrentFile, peerId [IDLEN]byte) (string, error) {
 		// 剩余多少，设为初始值
 		"left": []string{strconv.Itoa(tf.FileLen)},
 	}
+	if event != "" {
+		params.Set("event", event)
+	}
+	if trackerId != "" {
+		params.Set("trackerid", trackerId)
+	}
+	for _, ip := range local {
+		if ip.To4() != nil {
+			params.Set("ipv4", ip.String())
+		} else {
+			params.Set("ipv6", ip.String())
+		}
+	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-// FindPeers 找peer的下载地址
-func FindPeers(tf *TorrentFile, peerId [IDLEN]byte) []PeerInfo {
-	u, err := buildUrl(tf, peerId)
+// ErrNoTracker 种子中没有tracker的url
+var ErrNoTracker = errors.New("torrent: no tracker")
+
+// FindPeers 找peer的下载地址，hybrid种子同时向v1和v2的swarm请求
+//
+// Deprecated: 拿不到tracker的回复和错误，使用AnnounceTracker或者TorrentTask.Announce
+func FindPeers(ctx context.Context, tf *TorrentFile, peerId [IDLEN]byte) []PeerInfo {
+	peers, _, _ := AnnounceTracker(ctx, tf, peerId, EventStarted, nil)
+	return peers
+}
+
+// AnnounceTracker 向tracker汇报一次，hybrid种子同时向v1和v2的swarm汇报，results是每个swarm的结果，
+// 全部失败时返回第一个错误。trackerIds是每个swarm上一次回复的tracker id，会随请求发送并更新，为空时不使用
+func AnnounceTracker(ctx context.Context, tf *TorrentFile, peerId [IDLEN]byte, event string,
+	trackerIds map[[SHALEN]byte]string) (peers []PeerInfo, results []AnnounceResult, err error) {
+	if tf.Announce == "" {
+		return nil, nil, ErrNoTracker
+	}
+	peers = announceAll(ctx, tf, peerId, PeerPort, event, trackerIds, func(r AnnounceResult) {
+		results = append(results, r)
+	})
+	for _, r := range results {
+		if r.Err == nil {
+			return peers, results, nil
+		}
+	}
+	return peers, results, results[0].Err
+}
+
+// AnnounceStopped 告诉tracker不再参与，退出前调用，ctx不能是已经取消的，
+// trackerIds是之前AnnounceTracker使用的
+func AnnounceStopped(ctx context.Context, tf *TorrentFile, peerId [IDLEN]byte, trackerIds map[[SHALEN]byte]string) error {
+	_, _, err := AnnounceTracker(ctx, tf, peerId, EventStopped, trackerIds)
+	return err
+}
+
+// Announce 和AnnounceTracker一样，每次汇报的结果作为AnnounceResult发给订阅者，
+// 得到的peer同时加入候选，Download运行时会去连接
+func (t *TorrentTask) Announce(ctx context.Context, tf *TorrentFile, event string) []PeerInfo {
+	t.prepare()
+	port := t.port
+	if port == 0 {
+		port = PeerPort
+	}
+	// 同一个任务的汇报依次进行，tracker id按顺序更新
+	t.announceMu.Lock()
+	defer t.announceMu.Unlock()
+	if t.trackerIds == nil {
+		t.trackerIds = make(map[[SHALEN]byte]string)
+	}
+	peers := announceAll(ctx, tf, t.PeerId, port, event, t.trackerIds, func(r AnnounceResult) {
+		t.announceFailed = r.Err != nil
+		if r.Err == nil {
+			t.interval, t.minInterval = r.Interval, r.MinInterval
+		}
+		t.events.publish(r)
+	})
+	if event != EventStopped {
+		t.conns.add(t.filterPeers(peers))
+	}
+	return peers
+}
+
+const (
+	// tracker没有给interval时重新汇报的间隔
+	defaultAnnounceInterval = 30 * time.Minute
+	// 汇报失败之后重试的间隔
+	announceRetry = time.Minute
+)
+
+// announceInterval 下一次汇报之前等待的时间，不少于tracker要求的min interval
+func (t *TorrentTask) announceInterval() time.Duration {
+	t.announceMu.Lock()
+	defer t.announceMu.Unlock()
+	d := defaultAnnounceInterval
+	if t.announceFailed {
+		d = announceRetry
+	} else if t.interval > 0 {
+		d = time.Duration(t.interval) * time.Second
+	}
+	if min := time.Duration(t.minInterval) * time.Second; d < min {
+		d = min
+	}
+	return d
+}
+
+// announceRoutine 下载期间定期汇报，得到的新peer加入候选，停止时汇报stopped，
+// 在Download关闭事件之前返回，订阅者能收到stopped的结果
+func (t *TorrentTask) announceRoutine(tf *TorrentFile) {
+	for {
+		timer := time.NewTimer(t.announceInterval())
+		select {
+		case <-timer.C:
+			t.Announce(t.ctx, tf, "")
+		case <-t.ctx.Done():
+			timer.Stop()
+			ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+			t.Announce(ctx, tf, EventStopped)
+			cancel()
+			return
+		}
+	}
+}
+
+// announceAll port是本地监听的端口，ids保存每个swarm的tracker id，为空时不保存，
+// report不为空时报告每次汇报的结果
+func announceAll(ctx context.Context, tf *TorrentFile, peerId [IDLEN]byte, port int, event string,
+	ids map[[SHALEN]byte]string, report func(AnnounceResult)) []PeerInfo {
+	if tf.Announce == "" {
+		return nil
+	}
+	hashes := [][SHALEN]byte{tf.InfoSHA}
+	if tf.IsHybrid() {
+		hashes = append(hashes, tf.InfoSHAV2())
+	}
+	local := localIPs()
+	var peers []PeerInfo
+	for i, hash := range hashes {
+		resp, got, err := announce(ctx, tf, hash, peerId, port, event, local, ids[hash])
+		if err != nil {
+			log.Printf("Announce Error: %v\n", err)
+		}
+		n := 0
+		for _, p := range got {
+			// tracker可能把自己也返回，紧凑格式没有peer id
+			if p.ID != ([IDLEN]byte{}) && p.ID == peerId {
+				continue
+			}
+			p.V2 = i > 0
+			peers = append(peers, p)
+			n++
+		}
+		r := AnnounceResult{Tracker: tf.Announce, Event: event, V2: i > 0, Peers: n, Err: err}
+		if resp != nil {
+			if resp.WarningMessage != "" {
+				log.Printf("Announce Warning: %s\n", resp.WarningMessage)
+			}
+			if ids != nil && resp.TrackerID != "" {
+				ids[hash] = resp.TrackerID
+			}
+			r.Warning = resp.WarningMessage
+			r.Interval, r.MinInterval = resp.Interval, resp.MinInterval
+			r.Complete, r.Incomplete = resp.Complete, resp.Incomplete
+			r.TrackerID = resp.TrackerID
+		}
+		if report != nil {
+			report(r)
+		}
+	}
+	return peers
+}
+
+// localIPs 本机的公网ipv4和ipv6地址，每种最多一个，tracker可以据此把两种地址都告诉其他peer
+func localIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Printf("Build Tracker Url Error: %v\n", err)
 		return nil
 	}
-	cli := &http.Client{Timeout: 15 * time.Second}
+	var v4, v6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if v4 == nil {
+				v4 = ipNet.IP
+			}
+		} else if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	var ret []net.IP
+	for _, ip := range []net.IP{v4, v6} {
+		if ip != nil {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+// announce 有failure reason时返回错误，回复本身仍然返回
+func announce(ctx context.Context, tf *TorrentFile, infoSHA [SHALEN]byte, peerId [IDLEN]byte, port int, event string,
+	local []net.IP, trackerId string) (*TrackerResp, []PeerInfo, error) {
+	u, err := buildUrl(tf, infoSHA, peerId, port, event, local, trackerId)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
 	// 发送一个http get
-	resp, err := cli.Get(u)
+	resp, err := trackerClient.Do(req)
 	if err != nil {
-		log.Printf("Fail to Connect to Tracker: %v\n", err)
-		return nil
+		return nil, nil, fmt.Errorf("fail to connect to tracker: %w", err)
 	}
 	defer func() {
 		_ = resp.Body.Close()
@@ -80,28 +302,87 @@ func FindPeers(tf *TorrentFile, peerId [IDLEN]byte) []PeerInfo {
 	trackResp := &TrackerResp{}
 	// 是bencode格式，需要unmarshal
 	if err = bencode.Unmarshal(resp.Body, trackResp); err != nil {
-		log.Printf("Tracker Response Error: %v\n", err)
+		return nil, nil, fmt.Errorf("tracker response error: %w", err)
+	}
+	if trackResp.FailureReason != "" {
+		return trackResp, nil, fmt.Errorf("tracker failure: %s", trackResp.FailureReason)
+	}
+
+	peers := trackResp.peerList()
+	return trackResp, append(peers, buildPeerInfo6([]byte(trackResp.Peers6))...), nil
+}
+
+// peerList 解析peers，紧凑格式或者字典的列表
+func (r *TrackerResp) peerList() []PeerInfo {
+	if r.Peers == nil {
 		return nil
 	}
+	if s, err := r.Peers.Str(); err == nil {
+		return buildPeerInfo([]byte(s))
+	}
+	var infos []PeerInfo
+	r.Peers.Each(func(_ int, elem *bencode.BObject) bool {
+		if p, ok := parsePeerDict(elem); ok {
+			infos = append(infos, p)
+		}
+		return true
+	})
+	return infos
+}
 
-	return buildPeerInfo([]byte(trackResp.Peers))
+// parsePeerDict 非紧凑格式的peer，ip是点分十进制或者ipv6的文本，不支持域名，peer id可以没有
+func parsePeerDict(o *bencode.BObject) (PeerInfo, bool) {
+	dict, err := o.Dict()
+	if err != nil {
+		return PeerInfo{}, false
+	}
+	var host string
+	var port int
+	if v, ok := dict["ip"]; ok {
+		host, _ = v.Str()
+	}
+	if v, ok := dict["port"]; ok {
+		port, _ = v.Int()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || port <= 0 || port > 0xffff {
+		log.Printf("skip peer %q port %d\n", host, port)
+		return PeerInfo{}, false
+	}
+	p := PeerInfo{IP: ip, Port: uint16(port)}
+	if v, ok := dict["peer id"]; ok {
+		if id, err := v.Str(); err == nil && len(id) == IDLEN {
+			copy(p.ID[:], id)
+		}
+	}
+	return p, true
 }
 
 // 将紧凑排列的信息展开
 func buildPeerInfo(peers []byte) []PeerInfo {
+	return buildCompactPeers(peers, IpLen)
+}
+
+// buildPeerInfo6 peers6中每个peer是16字节的ip和2字节的端口
+func buildPeerInfo6(peers []byte) []PeerInfo {
+	return buildCompactPeers(peers, IPv6Len)
+}
+
+func buildCompactPeers(peers []byte, ipLen int) []PeerInfo {
+	peerLen := ipLen + PortLen
 	// 总长/ 每一位peer的信息位数
-	cnt := len(peers) / PeerLen
+	cnt := len(peers) / peerLen
 	// 不能整除就有bug
-	if len(peers)%PeerLen != 0 {
+	if len(peers)%peerLen != 0 {
 		log.Printf("Received malformed peers")
 		return nil
 	}
 	infos := make([]PeerInfo, cnt)
 	for i := 0; i < cnt; i++ {
-		offset := i * PeerLen
-		infos[i].IP = peers[offset : offset+IpLen]
+		offset := i * peerLen
+		infos[i].IP = peers[offset : offset+ipLen]
 		// 大小端转换
-		infos[i].Port = binary.BigEndian.Uint16(peers[offset+IpLen : offset+PeerLen])
+		infos[i].Port = binary.BigEndian.Uint16(peers[offset+ipLen : offset+peerLen])
 	}
 	return infos
 }
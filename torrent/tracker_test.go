@@ -2,9 +2,17 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"github.com/stretchr/testify/assert"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"sync/atomic"
 	"testing"
 )
 
@@ -13,8 +21,108 @@ func TestTracker(t *testing.T) {
 	tf, _ := ParseFile(bufio.NewReader(file))
 	var peerId [IDLEN]byte
 	_, _ = rand.Read(peerId[:])
-	peers := FindPeers(tf, peerId)
+	peers := FindPeers(context.Background(), tf, peerId)
 	for i, p := range peers {
 		log.Printf("Peer %d, Ip: %s, Port: %d\n", i+1, p.IP, p.Port)
 	}
 }
+
+func TestBuildPeerInfo6(t *testing.T) {
+	data := append(net.ParseIP("2001:db8::1"), 0x1a, 0xe1)
+	peers := buildPeerInfo6(data)
+	assert.Equal(t, 1, len(peers))
+	assert.Equal(t, "[2001:db8::1]:6881", peers[0].String())
+	assert.Equal(t, 0, len(buildPeerInfo6(data[:17])))
+}
+
+func TestTrackerPeers(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		// 非紧凑格式，ip可以是ipv4或者ipv6，域名不支持
+		_, _ = w.Write([]byte("d8:intervali900e5:peersl" +
+			"d2:ip9:127.0.0.27:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881ee" +
+			"d2:ip3:::14:porti6882ee" +
+			"d2:ip11:example.com4:porti6883ee" +
+			"e6:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x1a\xe4e"))
+	}))
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+	_, peers, err := announce(context.Background(), tf, tf.InfoSHA, [IDLEN]byte{}, PeerPort, EventStarted,
+		[]net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")}, "")
+	assert.Equal(t, nil, err)
+	var addrs []string
+	for _, p := range peers {
+		addrs = append(addrs, p.String())
+	}
+	assert.Equal(t, []string{"127.0.0.2:6881", "[::1]:6882", "[::2]:6884"}, addrs)
+	assert.Equal(t, "203.0.113.1", query.Get("ipv4"))
+	assert.Equal(t, "2001:db8::1", query.Get("ipv6"))
+	assert.Equal(t, byte('a'), peers[0].ID[0])
+}
+
+func TestTrackerResponse(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	var self [IDLEN]byte
+	copy(self[:], "-GT0001-selfselfself")
+	var ids []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.URL.Query().Get("trackerid"))
+		if r.URL.Query().Get("event") == EventStopped {
+			_, _ = w.Write([]byte("d14:failure reason12:unregisterede"))
+			return
+		}
+		// 字典格式中包含自己，要去掉
+		_, _ = w.Write([]byte("d8:completei5e10:incompletei3e8:intervali1800e12:min intervali60e" +
+			"5:peersld2:ip9:127.0.0.17:peer id20:-GT0001-selfselfself4:porti6881ee" +
+			"d2:ip9:127.0.0.24:porti6882eee" +
+			"10:tracker id3:abc15:warning message4:slowe"))
+	}))
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+	task := NewTask(tf, self, nil)
+	events, cancel := task.Subscribe()
+	defer cancel()
+
+	peers := task.Announce(context.Background(), tf, EventStarted)
+	assert.Equal(t, 1, len(peers))
+	assert.Equal(t, "127.0.0.2:6882", peers[0].String())
+	assert.Equal(t, AnnounceResult{
+		Tracker: tf.Announce, Event: EventStarted, Peers: 1, Warning: "slow",
+		Interval: 1800, MinInterval: 60, Complete: 5, Incomplete: 3, TrackerID: "abc",
+	}, <-events)
+
+	// 之后的汇报带上tracker id，failure reason作为错误
+	assert.Equal(t, 0, len(task.Announce(context.Background(), tf, EventStopped)))
+	r := (<-events).(AnnounceResult)
+	assert.Equal(t, "tracker failure: unregistered", r.Err.Error())
+	assert.Equal(t, []string{"", "abc"}, ids)
+
+	// 不通过任务汇报时错误直接返回
+	_, results, err := AnnounceTracker(context.Background(), tf, self, EventStopped, nil)
+	assert.Equal(t, "tracker failure: unregistered", err.Error())
+	assert.Equal(t, 1, len(results))
+}
+
+func TestDownloadIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 is not available")
+	}
+	_ = ln.Close()
+	data := []byte("helloworld!0123456789")
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, data},
+	})))
+	var active, peak int64
+	seed := listenSeedOn(t, "::1", tf.InfoSHA, 4, data, &active, &peak)
+	task := NewTask(tf, [IDLEN]byte{}, []PeerInfo{seed})
+	task.Dir = t.TempDir()
+	assert.Equal(t, nil, Download(context.Background(), task))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&peak))
+}
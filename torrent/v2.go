@@ -0,0 +1,353 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"go-torrent/bencode"
+)
+
+// BEP 52: v2种子使用sha256，每个文件单独建一棵merkle树，叶子是16KiB块的哈希
+const (
+	SHA256LEN   int = 32
+	MerkleBlock     = 16384
+)
+
+// PieceHashV2 v2中一个piece的merkle根，Leaves是计算时叶子补齐到的个数
+// 超过一个piece的文件每个piece都补齐到PieceLen/16KiB，只有一个piece的文件补齐到2的幂
+type PieceHashV2 struct {
+	Root   [SHA256LEN]byte
+	Leaves int
+}
+
+// v2File file tree中的一个文件
+type v2File struct {
+	path   []string
+	length int
+	root   [SHA256LEN]byte // pieces root，空文件没有
+	hashes []PieceHashV2
+}
+
+func hashPair(a, b [SHA256LEN]byte) [SHA256LEN]byte {
+	buf := make([]byte, 0, 2*SHA256LEN)
+	buf = append(buf, a[:]...)
+	buf = append(buf, b[:]...)
+	return sha256.Sum256(buf)
+}
+
+// merkleRoot 叶子补齐到width个后计算根，width必须是2的幂，补齐的叶子是pad
+func merkleRoot(leaves [][SHA256LEN]byte, width int, pad [SHA256LEN]byte) [SHA256LEN]byte {
+	layer := make([][SHA256LEN]byte, width)
+	copy(layer, leaves)
+	for i := len(leaves); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			layer[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+// zeroRoot 叶子全为零、共有leaves个叶子的子树的根
+func zeroRoot(leaves int) [SHA256LEN]byte {
+	var h [SHA256LEN]byte
+	for ; leaves > 1; leaves /= 2 {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// blockHashes 按16KiB切块计算叶子，最后一块可能短一些
+func blockHashes(data []byte) [][SHA256LEN]byte {
+	leaves := make([][SHA256LEN]byte, 0, (len(data)+MerkleBlock-1)/MerkleBlock)
+	for begin := 0; begin < len(data); begin += MerkleBlock {
+		end := begin + MerkleBlock
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, sha256.Sum256(data[begin:end]))
+	}
+	return leaves
+}
+
+// checkPieceV2 由块哈希算出piece的merkle根并比对，文件末尾之后的叶子为零
+func checkPieceV2(data []byte, h PieceHashV2) bool {
+	if h.Leaves == 0 {
+		return false
+	}
+	root := merkleRoot(blockHashes(data), h.Leaves, [SHA256LEN]byte{})
+	return bytes.Equal(root[:], h.Root[:])
+}
+
+// VerifyBlock 用merkle证明校验单个16KiB的块，proof是从下往上每一层的兄弟节点
+// index是块在树中的序号，root可以是piece的根，也可以是文件的pieces root
+func VerifyBlock(block []byte, index int, proof [][SHA256LEN]byte, root [SHA256LEN]byte) bool {
+	h := sha256.Sum256(block)
+	for _, sibling := range proof {
+		if index%2 == 0 {
+			h = hashPair(h, sibling)
+		} else {
+			h = hashPair(sibling, h)
+		}
+		index /= 2
+	}
+	return index == 0 && bytes.Equal(h[:], root[:])
+}
+
+// merkleProof 叶子补齐到width个后，第index个叶子到根路径上的兄弟节点，补齐的叶子为零
+func merkleProof(leaves [][SHA256LEN]byte, width, index int) [][SHA256LEN]byte {
+	layer := make([][SHA256LEN]byte, width)
+	copy(layer, leaves)
+	var proof [][SHA256LEN]byte
+	for len(layer) > 1 {
+		proof = append(proof, layer[index^1])
+		for i := 0; i < len(layer)/2; i++ {
+			layer[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+		index /= 2
+	}
+	return proof
+}
+
+// corruptBlocks piece通过校验后，用正确数据的叶子作为证明逐块校验之前失败的数据，
+// 返回其中不对的块在piece中的序号，bad和good都只包含文件本身的数据
+func corruptBlocks(bad, good []byte, h PieceHashV2) []int {
+	leaves := blockHashes(good)
+	var ret []int
+	for i, begin := 0, 0; begin < len(bad); i, begin = i+1, begin+MerkleBlock {
+		end := begin + MerkleBlock
+		if end > len(bad) {
+			end = len(bad)
+		}
+		if i >= h.Leaves || !VerifyBlock(bad[begin:end], i, merkleProof(leaves, h.Leaves, i), h.Root) {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// checkPieceHash 有v1哈希时用sha1校验(hybrid种子中包含填充的零)，有v2的merkle根时也要校验，
+// hybrid种子两种哈希都通过才算完整，v2只计算文件本身的数据，不包括后面的填充
+func checkPieceHash(idx int, data []byte, v1 [][SHALEN]byte, v2 []PieceHashV2, files []FileInfo, pieceLen int) bool {
+	if idx < len(v1) {
+		sha := sha1.Sum(data)
+		if !bytes.Equal(sha[:], v1[idx][:]) {
+			return false
+		}
+	}
+	// hybrid种子中只有填充的piece没有v2哈希
+	if idx < len(v2) && v2[idx].Leaves > 0 {
+		return checkPieceV2(data[:fileDataLen(files, idx*pieceLen, len(data))], v2[idx])
+	}
+	return idx < len(v1)
+}
+
+// fileDataLen 从begin开始的n个字节中属于begin所在文件的长度，后面是填充文件或者下一个文件
+func fileDataLen(files []FileInfo, begin, n int) int {
+	for _, f := range files {
+		if !f.Padding && begin >= f.Offset && begin < f.Offset+f.Length {
+			if end := f.Offset + f.Length; begin+n > end {
+				return end - begin
+			}
+			return n
+		}
+	}
+	return n
+}
+
+// pieceCount 纯v2种子没有v1的pieces
+func pieceCount(v1 [][SHALEN]byte, v2 []PieceHashV2) int {
+	if len(v1) > 0 {
+		return len(v1)
+	}
+	return len(v2)
+}
+
+// alignedBounds 纯v2种子中每个文件从新的piece开始，piece不会跨文件，文件的最后一个piece到文件末尾为止
+func alignedBounds(pieceLen int, files []FileInfo, idx int) (begin, end int) {
+	begin = idx * pieceLen
+	for _, f := range files {
+		if begin >= f.Offset && begin < f.Offset+f.Length {
+			end = begin + pieceLen
+			if end > f.Offset+f.Length {
+				end = f.Offset + f.Length
+			}
+			return begin, end
+		}
+	}
+	return begin, begin
+}
+
+// parseFileTree 深度优先遍历file tree，字典按key排序，文件顺序是确定的
+// 文件节点是只包含空字符串key的字典，里面有length和pieces root
+func parseFileTree(tree *bencode.BObject, prefix []string) ([]v2File, error) {
+	dict, err := tree.Dict()
+	if err != nil {
+		return nil, fmt.Errorf("file tree: %v is not a directory", prefix)
+	}
+	var files []v2File
+	for _, name := range tree.Keys() {
+		path := append(append([]string{}, prefix...), name)
+		node, err := dict[name].Dict()
+		if err != nil {
+			return nil, fmt.Errorf("file tree: %v is not a dictionary", path)
+		}
+		leaf, ok := node[""]
+		if !ok {
+			sub, err := parseFileTree(dict[name], path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+			continue
+		}
+		if name == "" || len(node) != 1 {
+			return nil, fmt.Errorf("file tree: malformed file entry %v", path)
+		}
+		f, err := parseFileEntry(leaf, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func parseFileEntry(leaf *bencode.BObject, path []string) (v2File, error) {
+	f := v2File{path: path}
+	length, err := leaf.Get("length")
+	if err == nil {
+		f.length, err = length.Int()
+	}
+	if err != nil || f.length < 0 {
+		return f, fmt.Errorf("file tree: invalid length of %v", path)
+	}
+	if f.length == 0 {
+		return f, nil
+	}
+	root, err := leaf.Get("pieces root")
+	if err != nil {
+		return f, fmt.Errorf("file tree: %v has no pieces root", path)
+	}
+	str, err := root.Str()
+	if err != nil || len(str) != SHA256LEN {
+		return f, fmt.Errorf("file tree: invalid pieces root of %v", path)
+	}
+	copy(f.root[:], str)
+	return f, nil
+}
+
+// pieceHashesV2 生成文件每个piece的哈希，多piece的文件从piece layers取，并用pieces root校验
+func pieceHashesV2(f v2File, pieceLen int, layers map[string]string) ([]PieceHashV2, error) {
+	if f.length == 0 {
+		return nil, nil
+	}
+	perPiece := pieceLen / MerkleBlock
+	if f.length <= pieceLen {
+		// 只有一个piece的文件没有layer，piece的根就是pieces root
+		blocks := (f.length + MerkleBlock - 1) / MerkleBlock
+		return []PieceHashV2{{Root: f.root, Leaves: nextPow2(blocks)}}, nil
+	}
+	cnt := (f.length + pieceLen - 1) / pieceLen
+	layer, ok := layers[string(f.root[:])]
+	if !ok || len(layer) != cnt*SHA256LEN {
+		return nil, fmt.Errorf("piece layers: missing or malformed layer for %v", f.path)
+	}
+	nodes := make([][SHA256LEN]byte, cnt)
+	ret := make([]PieceHashV2, cnt)
+	for i := range nodes {
+		copy(nodes[i][:], layer[i*SHA256LEN:])
+		ret[i] = PieceHashV2{Root: nodes[i], Leaves: perPiece}
+	}
+	// layer补齐的部分是叶子全为零的piece子树
+	if merkleRoot(nodes, nextPow2(cnt), zeroRoot(perPiece)) != f.root {
+		return nil, fmt.Errorf("piece layers: layer for %v does not match pieces root", f.path)
+	}
+	return ret, nil
+}
+
+// parseV2 解析file tree和piece layers，单个文件时直接使用文件名，否则放在name目录下
+func parseV2(name string, pieceLen int, tree *bencode.BObject, layers map[string]string) ([]v2File, error) {
+	if pieceLen < MerkleBlock || pieceLen&(pieceLen-1) != 0 {
+		return nil, errors.New("v2 piece length must be a power of two and at least 16KiB")
+	}
+	if tree == nil {
+		return nil, errors.New("v2 torrent has no file tree")
+	}
+	files, err := parseFileTree(tree, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("file tree is empty")
+	}
+	if len(files) > 1 || len(files[0].path) > 1 {
+		for i := range files {
+			files[i].path = append([]string{name}, files[i].path...)
+		}
+	}
+	for i := range files {
+		if files[i].hashes, err = pieceHashesV2(files[i], pieceLen, layers); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// layoutV2 纯v2种子的文件按piece对齐排列，文件之间的空隙不存在于任何文件中
+func layoutV2(files []v2File, pieceLen int) ([]FileInfo, []PieceHashV2, int) {
+	infos := make([]FileInfo, len(files))
+	var hashes []PieceHashV2
+	off, total := 0, 0
+	for i, f := range files {
+		infos[i] = FileInfo{Path: f.path, Length: f.length, Offset: off, PiecesRoot: f.root}
+		hashes = append(hashes, f.hashes...)
+		total = off + f.length
+		off += len(f.hashes) * pieceLen
+	}
+	return infos, hashes, total
+}
+
+// attachV2 hybrid种子以v1的文件列表为准，其中的填充文件保证每个文件都从新的piece开始，
+// 所以两边piece的序号一致，按路径找到对应的pieces root
+func attachV2(files []FileInfo, v2 []v2File, pieceLen int) ([]PieceHashV2, error) {
+	byPath := make(map[string]v2File, len(v2))
+	for _, f := range v2 {
+		byPath[fmt.Sprintf("%q", f.path)] = f
+	}
+	var hashes []PieceHashV2
+	for i := range files {
+		f := &files[i]
+		if f.Padding || f.Length == 0 {
+			continue
+		}
+		vf, ok := byPath[fmt.Sprintf("%q", f.Path)]
+		if !ok || vf.length != f.Length {
+			return nil, fmt.Errorf("hybrid torrent: file %v does not match the file tree", f.Path)
+		}
+		if f.Offset%pieceLen != 0 {
+			return nil, fmt.Errorf("hybrid torrent: file %v is not piece aligned", f.Path)
+		}
+		f.PiecesRoot = vf.root
+		// 中间只有填充文件的piece不会出现，这里只是保证序号对齐
+		for len(hashes) < f.Offset/pieceLen {
+			hashes = append(hashes, PieceHashV2{})
+		}
+		hashes = append(hashes, vf.hashes...)
+	}
+	return hashes, nil
+}
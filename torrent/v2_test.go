@@ -0,0 +1,268 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"github.com/stretchr/testify/assert"
+	"go-torrent/bencode"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// fileRoot 计算文件的pieces root，超过一个piece时同时返回piece layer
+func fileRoot(data []byte, pieceLen int) ([SHA256LEN]byte, []byte) {
+	blocks := blockHashes(data)
+	if len(data) <= pieceLen {
+		return merkleRoot(blocks, nextPow2(len(blocks)), [SHA256LEN]byte{}), nil
+	}
+	per := pieceLen / MerkleBlock
+	var nodes [][SHA256LEN]byte
+	layer := new(bytes.Buffer)
+	for begin := 0; begin < len(blocks); begin += per {
+		end := begin + per
+		if end > len(blocks) {
+			end = len(blocks)
+		}
+		h := merkleRoot(blocks[begin:end], per, [SHA256LEN]byte{})
+		nodes = append(nodes, h)
+		layer.Write(h[:])
+	}
+	return merkleRoot(nodes, nextPow2(len(nodes)), zeroRoot(per)), layer.Bytes()
+}
+
+// makeTorrentV2 生成v2种子，hybrid时同时生成带填充文件的v1文件列表和pieces
+func makeTorrentV2(name string, pieceLen int, files []testFile, hybrid bool) []byte {
+	tree := bencode.NewDict()
+	layers := bencode.NewDict()
+	v1 := bencode.NewList()
+	var all []byte
+	for i, f := range files {
+		entry := bencode.NewDict()
+		_ = entry.Set("length", bencode.NewInt(int64(len(f.data))))
+		if len(f.data) > 0 {
+			root, layer := fileRoot(f.data, pieceLen)
+			_ = entry.Set("pieces root", bencode.NewString(string(root[:])))
+			if layer != nil {
+				_ = layers.Set(string(root[:]), bencode.NewString(string(layer)))
+			}
+		}
+		node := tree
+		for _, p := range f.path {
+			next, err := node.Get(p)
+			if err != nil {
+				next = bencode.NewDict()
+				_ = node.Set(p, next)
+			}
+			node = next
+		}
+		_ = node.Set("", entry)
+
+		all = append(all, f.data...)
+		_ = v1.Append(v1Entry(f.path, len(f.data), ""))
+		// 最后一个文件之后不需要填充
+		if pad := (pieceLen - len(all)%pieceLen) % pieceLen; pad > 0 && i < len(files)-1 {
+			all = append(all, make([]byte, pad)...)
+			_ = v1.Append(v1Entry([]string{".pad", strconv.Itoa(pad)}, pad, "p"))
+		}
+	}
+	info := bencode.NewDict()
+	_ = info.Set("name", bencode.NewString(name))
+	_ = info.Set("piece length", bencode.NewInt(int64(pieceLen)))
+	_ = info.Set("meta version", bencode.NewInt(2))
+	_ = info.Set("file tree", tree)
+	if hybrid {
+		pieces := new(bytes.Buffer)
+		for begin := 0; begin < len(all); begin += pieceLen {
+			end := begin + pieceLen
+			if end > len(all) {
+				end = len(all)
+			}
+			sum := sha1.Sum(all[begin:end])
+			pieces.Write(sum[:])
+		}
+		_ = info.Set("pieces", bencode.NewString(pieces.String()))
+		_ = info.Set("files", v1)
+	}
+	root := bencode.NewDict()
+	_ = root.Set("announce", bencode.NewString("http://127.0.0.1/announce"))
+	_ = root.Set("info", info)
+	_ = root.Set("piece layers", layers)
+	buf := new(bytes.Buffer)
+	_, _ = root.WriteTo(buf)
+	return buf.Bytes()
+}
+
+func v1Entry(path []string, length int, attr string) *bencode.BObject {
+	entry := bencode.NewDict()
+	_ = entry.Set("length", bencode.NewInt(int64(length)))
+	list := bencode.NewList()
+	for _, p := range path {
+		_ = list.Append(bencode.NewString(p))
+	}
+	_ = entry.Set("path", list)
+	if attr != "" {
+		_ = entry.Set("attr", bencode.NewString(attr))
+	}
+	return entry
+}
+
+func writeFiles(t *testing.T, dir string, files []testFile) {
+	for _, f := range files {
+		path := filepath.Join(append([]string{dir, "v2"}, f.path...)...)
+		assert.Equal(t, nil, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Equal(t, nil, os.WriteFile(path, f.data, 0644))
+	}
+}
+
+func testData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i) ^ seed
+	}
+	return data
+}
+
+func TestMerkle(t *testing.T) {
+	// 只有一个块时根就是块的哈希
+	block := testData(100, 1)
+	root, _ := fileRoot(block, MerkleBlock)
+	assert.Equal(t, sha256.Sum256(block), root)
+
+	// 按piece分层计算的根和直接对所有块补零计算的一样
+	data := testData(5*MerkleBlock+10, 2)
+	root, layer := fileRoot(data, 2*MerkleBlock)
+	assert.Equal(t, 3*SHA256LEN, len(layer))
+	assert.Equal(t, merkleRoot(blockHashes(data), 8, [SHA256LEN]byte{}), root)
+
+	// 用兄弟节点证明最后一个块，序号是5
+	leaves := blockHashes(data)
+	proof := merkleProof(leaves, 8, 5)
+	assert.Equal(t, 3, len(proof))
+	blk := data[5*MerkleBlock:]
+	assert.True(t, VerifyBlock(blk, 5, proof, root))
+	assert.False(t, VerifyBlock(blk, 4, proof, root))
+	assert.False(t, VerifyBlock(data[:MerkleBlock], 5, proof, root))
+}
+
+func TestCorruptBlocks(t *testing.T) {
+	good := testData(3*MerkleBlock+100, 6)
+	tf, _ := ParseFile(bytes.NewReader(makeTorrentV2("a.bin", 4*MerkleBlock, []testFile{
+		{[]string{"a.bin"}, good},
+	}, false)))
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	events, cancel := task.Subscribe()
+	defer cancel()
+	// 第2块改坏一个字节
+	bad := append([]byte{}, good...)
+	bad[2*MerkleBlock+7] ^= 1
+	assert.False(t, task.checkPiece(&pieceResult{0, bad}, "bad peer", nil))
+	assert.Equal(t, PieceFailed{Index: 0, From: "bad peer"}, <-events)
+	assert.True(t, task.checkPiece(&pieceResult{0, good}, "good peer", nil))
+	assert.Equal(t, CorruptBlocks{Index: 0, Blocks: []int{2}, From: "bad peer"}, <-events)
+	assert.Equal(t, PieceVerified{Index: 0, Length: len(good), From: "good peer"}, <-events)
+}
+
+func TestParseV2(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.bin"}, testData(40000, 3)},
+		{[]string{"sub", "b.txt"}, []byte("hello v2")},
+		{[]string{"sub", "empty"}, nil},
+	}
+	data := makeTorrentV2("v2", MerkleBlock, files, false)
+	tf, err := ParseFile(bytes.NewReader(data))
+	assert.Equal(t, nil, err)
+	assert.True(t, tf.IsV2())
+	assert.False(t, tf.IsHybrid())
+	assert.Equal(t, sha256.Sum256(tf.RawInfo), tf.InfoSHA256)
+	assert.Equal(t, tf.InfoSHAV2(), tf.InfoSHA)
+	assert.Equal(t, 0, len(tf.PieceSHA))
+	assert.Equal(t, 4, tf.PieceCount())
+	// 文件按piece对齐
+	assert.Equal(t, 0, tf.Files[0].Offset)
+	assert.Equal(t, 3*MerkleBlock, tf.Files[1].Offset)
+	assert.Equal(t, []string{"v2", "sub", "b.txt"}, tf.Files[1].Path)
+	begin, end := tf.PieceBounds(2)
+	assert.Equal(t, 2*MerkleBlock, begin)
+	assert.Equal(t, 40000, end)
+	begin, end = tf.PieceBounds(3)
+	assert.Equal(t, 3*MerkleBlock, begin)
+	assert.Equal(t, 3*MerkleBlock+8, end)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	res, err := Verify(tf, dir, 2)
+	assert.Equal(t, nil, err)
+	assert.True(t, res.OK())
+
+	corrupt := append([]byte{}, files[0].data...)
+	corrupt[MerkleBlock+5] ^= 0xff
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(dir, "v2", "a.bin"), corrupt, 0644))
+	res, _ = Verify(tf, dir, 1)
+	assert.Equal(t, []PieceStatus{PieceComplete, PieceCorrupt, PieceComplete, PieceComplete}, res.Pieces)
+}
+
+func TestParseV2BadLayer(t *testing.T) {
+	data := makeTorrentV2("v2", MerkleBlock, []testFile{{[]string{"a.bin"}, testData(40000, 4)}}, false)
+	root, _ := bencode.Parse(bytes.NewReader(data))
+	layers, _ := root.Get("piece layers")
+	layers.Range(func(key string, val *bencode.BObject) bool {
+		str, _ := val.Str()
+		b := []byte(str)
+		b[0] ^= 1
+		val.SetString(string(b))
+		return true
+	})
+	buf := new(bytes.Buffer)
+	_, _ = root.WriteTo(buf)
+	_, err := ParseFile(buf)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseHybrid(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.bin"}, testData(40000, 5)},
+		{[]string{"b.txt"}, []byte("hybrid")},
+	}
+	tf, err := ParseFile(bytes.NewReader(makeTorrentV2("v2", MerkleBlock, files, true)))
+	assert.Equal(t, nil, err)
+	assert.True(t, tf.IsHybrid())
+	assert.Equal(t, sha1.Sum(tf.RawInfo), tf.InfoSHA)
+	v2 := tf.InfoSHAV2()
+	assert.Equal(t, tf.InfoSHA256[:SHALEN], v2[:])
+	assert.Equal(t, 3, len(tf.Files))
+	assert.True(t, tf.Files[1].Padding)
+	assert.Equal(t, len(tf.PieceSHA), len(tf.PieceSHA256))
+	assert.NotEqual(t, [SHA256LEN]byte{}, tf.Files[2].PiecesRoot)
+	// v2的哈希对应去掉填充之后的文件数据
+	assert.True(t, checkPieceV2(files[0].data[2*MerkleBlock:], tf.PieceSHA256[2]))
+	assert.True(t, checkPieceV2(files[1].data, tf.PieceSHA256[3]))
+	// 完整的piece包含后面的填充，v1和v2都要通过
+	piece := make([]byte, MerkleBlock)
+	copy(piece, files[0].data[2*MerkleBlock:])
+	assert.True(t, tf.CheckPiece(2, piece))
+	tf.PieceSHA256[2].Root[0] ^= 1
+	assert.False(t, tf.CheckPiece(2, piece))
+	tf.PieceSHA256[2].Root[0] ^= 1
+
+	// 填充文件不需要在磁盘上
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	res, err := Verify(tf, dir, 2)
+	assert.Equal(t, nil, err)
+	assert.True(t, res.OK())
+	assert.Equal(t, 2, len(res.Files))
+}
+
+func TestHandshakeV2Bit(t *testing.T) {
+	msg := NewHandshakeMsg([SHALEN]byte{1}, [IDLEN]byte{2})
+	msg.SetV2()
+	buf := new(bytes.Buffer)
+	_, _ = WriteHandshake(buf, msg)
+	res, err := ReadHandshake(buf)
+	assert.Equal(t, nil, err)
+	assert.True(t, res.V2())
+	assert.Equal(t, msg.InfoSHA, res.InfoSHA)
+}
@@ -0,0 +1,175 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// PieceStatus 校验后每个piece的状态
+type PieceStatus uint8
+
+const (
+	PieceComplete PieceStatus = iota // 数据完整且哈希一致
+	PieceMissing                     // 涉及的文件不存在或者长度不够
+	PieceCorrupt                     // 数据齐全但是哈希不一致
+)
+
+func (s PieceStatus) String() string {
+	switch s {
+	case PieceComplete:
+		return "complete"
+	case PieceMissing:
+		return "missing"
+	case PieceCorrupt:
+		return "corrupt"
+	}
+	return "unknown"
+}
+
+// FileStatus 单个文件的校验结果，和文件有重叠的piece都完整时文件才算完整
+type FileStatus struct {
+	Path    string
+	Length  int
+	Exists  bool
+	Missing []int // 缺失的piece序号
+	Corrupt []int // 损坏的piece序号
+}
+
+func (f *FileStatus) Complete() bool {
+	return f.Exists && len(f.Missing) == 0 && len(f.Corrupt) == 0
+}
+
+type VerifyResult struct {
+	Pieces []PieceStatus
+	Files  []FileStatus
+}
+
+// OK 所有piece都完整
+func (r *VerifyResult) OK() bool {
+	for _, s := range r.Pieces {
+		if s != PieceComplete {
+			return false
+		}
+	}
+	return true
+}
+
+// Count 某个状态的piece个数
+func (r *VerifyResult) Count(status PieceStatus) int {
+	cnt := 0
+	for _, s := range r.Pieces {
+		if s == status {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// pieceBounds 第idx个piece在整体中的起止位置，最后一个piece可能会短一些
+func pieceBounds(pieceLen, total, idx int) (begin, end int) {
+	begin = idx * pieceLen
+	end = begin + pieceLen
+	if end > total {
+		end = total
+	}
+	return begin, end
+}
+
+// Verify 读取dir下已经存在的数据，并行地逐个piece校验，v2种子使用merkle根
+// workers小于等于0时使用CPU个数
+func Verify(tf *TorrentFile, dir string, workers int) (*VerifyResult, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	// tf可能不是ParseFile得到的，哈希个数和文件长度对不上时无法校验
+	if tf.PieceLen <= 0 || (len(tf.PieceSHA) > 0 && len(tf.PieceSHA) != (tf.FileLen+tf.PieceLen-1)/tf.PieceLen) {
+		return nil, errors.New("torrent: piece hashes do not match file length")
+	}
+	for _, f := range tf.Files {
+		if f.Length < 0 {
+			return nil, fmt.Errorf("torrent: invalid length of %v", f.Path)
+		}
+	}
+	store := newFileStorage(dir, tf.Files, false)
+	defer func() {
+		_ = store.Close()
+	}()
+	// 先确认路径都是安全的，避免读到下载目录之外
+	for _, f := range tf.Files {
+		if _, err := filePath(dir, f); err != nil {
+			return nil, err
+		}
+	}
+	res := &VerifyResult{Pieces: make([]PieceStatus, tf.PieceCount())}
+	idxCh := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, tf.PieceLen)
+			for idx := range idxCh {
+				res.Pieces[idx] = verifyPiece(store, tf, idx, buf)
+			}
+		}()
+	}
+	for idx := range res.Pieces {
+		idxCh <- idx
+	}
+	close(idxCh)
+	wg.Wait()
+
+	for _, f := range tf.Files {
+		if f.Padding {
+			continue
+		}
+		fs := FileStatus{Path: strings.Join(f.Path, "/"), Length: f.Length}
+		path, _ := filePath(dir, f)
+		if _, err := os.Stat(path); err == nil {
+			fs.Exists = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, idx := range filePieces(tf.PieceLen, f) {
+			switch res.Pieces[idx] {
+			case PieceMissing:
+				fs.Missing = append(fs.Missing, idx)
+			case PieceCorrupt:
+				fs.Corrupt = append(fs.Corrupt, idx)
+			}
+		}
+		res.Files = append(res.Files, fs)
+	}
+	return res, nil
+}
+
+func verifyPiece(store *fileStorage, tf *TorrentFile, idx int, buf []byte) PieceStatus {
+	begin, end := tf.PieceBounds(idx)
+	data := buf[:end-begin]
+	// 文件不存在，长度不够或者无法读取都算作缺失
+	if _, err := store.ReadAt(data, int64(begin)); err != nil {
+		return PieceMissing
+	}
+	if !tf.CheckPiece(idx, data) {
+		return PieceCorrupt
+	}
+	return PieceComplete
+}
+
+// filePieces 和文件有重叠的piece序号，空文件不属于任何piece
+func filePieces(pieceLen int, f FileInfo) []int {
+	if f.Length == 0 {
+		return nil
+	}
+	first := f.Offset / pieceLen
+	last := (f.Offset + f.Length - 1) / pieceLen
+	ret := make([]int, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		ret = append(ret, i)
+	}
+	return ret
+}
@@ -0,0 +1,78 @@
+package torrent
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"sub", "b.txt"}, []byte("world!")},
+		{[]string{"c.txt"}, []byte("0123456789")},
+	}
+	tf, err := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, files)))
+	assert.Equal(t, nil, err)
+
+	dir := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(append([]string{dir, "bundle"}, f.path...)...)
+		assert.Equal(t, nil, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Equal(t, nil, os.WriteFile(path, f.data, 0644))
+	}
+	res, err := Verify(tf, dir, 2)
+	assert.Equal(t, nil, err)
+	assert.True(t, res.OK())
+	for _, f := range res.Files {
+		assert.True(t, f.Complete(), f.Path)
+	}
+
+	// 改坏b.txt的最后一个字节，删掉c.txt
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(dir, "bundle", "sub", "b.txt"), []byte("world?"), 0644))
+	assert.Equal(t, nil, os.Remove(filepath.Join(dir, "bundle", "c.txt")))
+	res, err = Verify(tf, dir, 0)
+	assert.Equal(t, nil, err)
+	assert.False(t, res.OK())
+	// 整体是 hell|owor|ld!0|1234|5678|9
+	assert.Equal(t, []PieceStatus{PieceComplete, PieceComplete, PieceMissing, PieceMissing, PieceMissing, PieceMissing}, res.Pieces)
+	assert.True(t, res.Files[0].Complete())
+	assert.Equal(t, []int{2}, res.Files[1].Missing)
+	assert.False(t, res.Files[2].Exists)
+	assert.Equal(t, []int{2, 3, 4, 5}, res.Files[2].Missing)
+
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(dir, "bundle", "c.txt"), []byte("0123456789"), 0644))
+	res, _ = Verify(tf, dir, 0)
+	assert.Equal(t, PieceCorrupt, res.Pieces[2])
+	assert.Equal(t, []int{2}, res.Files[1].Corrupt)
+	assert.Equal(t, []int{2}, res.Files[2].Corrupt)
+	assert.Equal(t, 1, res.Count(PieceCorrupt))
+}
+
+func TestVerifyUnsafePath(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, []testFile{
+		{[]string{"..", "escape"}, []byte("data")},
+	})))
+	_, err := Verify(tf, t.TempDir(), 1)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"b.txt"}, []byte("world!")},
+	})))
+	// 不是ParseFile得到的种子也不能panic
+	tf.PieceSHA = tf.PieceSHA[:1]
+	_, err := Verify(tf, t.TempDir(), 1)
+	assert.NotEqual(t, nil, err)
+
+	tf, _ = ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+	})))
+	tf.Files[0].Length = -5
+	_, err = Verify(tf, t.TempDir(), 1)
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,145 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 连续失败这么多次之后不再使用这个web seed
+const maxWebSeedFails = 3
+
+// webSeed BEP 19: url-list中的地址被当作一个拥有全部piece的peer，用http的Range请求获取数据
+type webSeed struct {
+	base   string
+	files  []FileInfo
+	multi  bool // 多文件种子的url是目录，后面拼上name和文件路径
+	client *http.Client
+	ctx    context.Context // 取消时中断正在进行的请求
+	down   []*Limiter      // 下载限速
+}
+
+func newWebSeed(base string, files []FileInfo) (*webSeed, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported web seed scheme: %s", base)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("web seed needs the file list")
+	}
+	return &webSeed{
+		base:   base,
+		files:  files,
+		multi:  len(files) > 1 || len(files[0].Path) > 1,
+		client: &http.Client{Timeout: 30 * time.Second},
+		ctx:    context.Background(),
+	}, nil
+}
+
+// fileURL 单文件时url以/结尾才拼上文件名，多文件时总是拼上name和路径
+func (w *webSeed) fileURL(f FileInfo) string {
+	if !w.multi && !strings.HasSuffix(w.base, "/") {
+		return w.base
+	}
+	parts := make([]string, len(f.Path))
+	for i, p := range f.Path {
+		parts[i] = url.PathEscape(p)
+	}
+	base := w.base
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// ReadAt 按整体的偏移读取，跨越多个文件时每个文件发一个请求
+func (w *webSeed) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for _, f := range w.files {
+		fileOff, begin, end, ok := overlap(f, off, len(p))
+		if !ok {
+			continue
+		}
+		if f.Padding {
+			for j := begin; j < end; j++ {
+				p[j] = 0
+			}
+			read += end - begin
+			continue
+		}
+		if err := w.fetch(f, fileOff, p[begin:end]); err != nil {
+			return read, err
+		}
+		read += end - begin
+	}
+	if read < len(p) {
+		return read, io.ErrUnexpectedEOF
+	}
+	return read, nil
+}
+
+func (w *webSeed) fetch(f FileInfo, off int64, buf []byte) error {
+	u := w.fileURL(f)
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(buf))-1))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body := io.Reader(&limitedReader{Reader: resp.Body, ctx: w.ctx, down: w.down})
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// 服务器不支持Range，跳过前面的部分
+		if _, err = io.CopyN(io.Discard, body, off); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("web seed %s: %s", u, resp.Status)
+	}
+	_, err = io.ReadFull(body, buf)
+	return err
+}
+
+// webSeedRoutine 和peer连接一样从picker取任务，下载的数据同样要通过checkPiece
+func (t *TorrentTask) webSeedRoutine(ws *webSeed) {
+	fails := 0
+	all := func(int) bool { return true }
+	for {
+		idx, ok := t.pk.next(all)
+		if !ok {
+			return
+		}
+		begin, end := t.getPieceBounds(idx)
+		res := &pieceResult{idx, make([]byte, end-begin)}
+		if _, err := ws.ReadAt(res.data, int64(begin)); err != nil {
+			log.Printf("fail to download piece %d from web seed %s: %v\n", idx, ws.base, err)
+		} else if t.checkPiece(res, ws.base, nil) {
+			fails = 0
+			if !t.deliver(res) {
+				return
+			}
+			continue
+		}
+		t.pk.giveBack(idx)
+		if fails++; fails >= maxWebSeedFails {
+			log.Printf("give up web seed %s after %d failures\n", ws.base, fails)
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFiles 按照name/路径提供文件，使用ServeContent以支持Range请求
+func serveFiles(name string, files []testFile, corrupt bool) *httptest.Server {
+	content := make(map[string][]byte)
+	for _, f := range files {
+		content["/"+strings.Join(append([]string{name}, f.path...), "/")] = f.data
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := content[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if corrupt {
+			data = bytes.ToUpper(data)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestWebSeedReadAt(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"sub", "b c.txt"}, []byte("world!")},
+		{[]string{"c.txt"}, []byte("0123456789")},
+	}
+	srv := serveFiles("bundle", files, false)
+	defer srv.Close()
+	tf, err := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, files)))
+	assert.Equal(t, nil, err)
+
+	ws, err := newWebSeed(srv.URL, tf.Files)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, srv.URL+"/bundle/sub/b%20c.txt", ws.fileURL(tf.Files[1]))
+	// 跨越三个文件
+	buf := make([]byte, 9)
+	n, err := ws.ReadAt(buf, 3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 9, n)
+	assert.Equal(t, "loworld!0", string(buf))
+
+	_, err = newWebSeed("ftp://example.com/", tf.Files)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestWebSeedSingleFileURL(t *testing.T) {
+	files := []FileInfo{{Path: []string{"a.iso"}, Length: 10}}
+	ws, _ := newWebSeed("http://host/pub/a.iso", files)
+	assert.Equal(t, "http://host/pub/a.iso", ws.fileURL(files[0]))
+	ws, _ = newWebSeed("http://host/pub/", files)
+	assert.Equal(t, "http://host/pub/a.iso", ws.fileURL(files[0]))
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.txt"}, []byte("hello")},
+		{[]string{"sub", "b.txt"}, []byte("world!")},
+	}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("bundle", 4, files)))
+	srv := serveFiles("bundle", files, false)
+	defer srv.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	task.WebSeeds = []string{srv.URL + "/"}
+	task.Dir = t.TempDir()
+	assert.Equal(t, nil, Download(context.Background(), task))
+	res, err := Verify(tf, task.Dir, 1)
+	assert.Equal(t, nil, err)
+	assert.True(t, res.OK())
+}
+
+func TestWebSeedCorrupt(t *testing.T) {
+	files := []testFile{{[]string{"a.txt"}, []byte("hello world")}}
+	tf, _ := ParseFile(bytes.NewReader(makeTorrent("a.txt", 4, files)))
+	srv := serveFiles("bundle", files, true)
+	defer srv.Close()
+	task := NewTask(tf, [IDLEN]byte{}, nil)
+	ws, _ := newWebSeed(srv.URL+"/bundle/", task.Files)
+
+	task.prepare()
+	pk := task.pk
+	done := make(chan struct{})
+	go func() {
+		task.webSeedRoutine(ws)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("web seed routine did not give up")
+	}
+	// 校验失败的piece放回去，没有被标记为完成
+	assert.Equal(t, 3, pk.left)
+	assert.Equal(t, []pieceState{statePending, statePending, statePending}, pk.state)
+}